@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ymakhloufi/litemigrate/pkg/migrator"
+)
+
+type runFunc func(ctx context.Context, svc *migrator.Service, args []string) error
+
+type command struct {
+	args        string
+	description string
+	needsStore  bool
+	// setup registers the command's own flags and returns the function that runs the command once they're parsed
+	setup func(flags *flag.FlagSet, opts *options) runFunc
+}
+
+var commands = map[string]command{
+	"up": {
+		description: "Apply all pending migrations, or only those up to and including the -to target.",
+		needsStore:  true,
+		setup: func(flags *flag.FlagSet, opts *options) runFunc {
+			target := flags.String("to", "", "filename or numeric version prefix of the last migration to apply")
+			flags.BoolVar(&opts.dryRun, "dry-run", getEnv("DRY_RUN", "false") == "true", "print the pending migrations instead of running them (env DRY_RUN)")
+			opts.tenants.register(flags)
+			opts.metrics.register(flags)
+			return func(ctx context.Context, svc *migrator.Service, _ []string) error {
+				if *target != "" {
+					return svc.UpToContext(ctx, *target)
+				}
+				return svc.UpContext(ctx)
+			}
+		},
+	},
+	"plan": {
+		description: "Print every pending migration with its full SQL without running anything, like up -dry-run.",
+		needsStore:  true,
+		setup: func(flags *flag.FlagSet, _ *options) runFunc {
+			target := flags.String("to", "", "filename or numeric version prefix of the last migration to include")
+			return func(ctx context.Context, svc *migrator.Service, _ []string) error {
+				var plan migrator.Plan
+				var err error
+				if *target != "" {
+					plan, err = svc.PlanUpToContext(ctx, *target)
+				} else {
+					plan, err = svc.PlanContext(ctx)
+				}
+				if err != nil {
+					return err
+				}
+				return plan.Print(os.Stdout)
+			}
+		},
+	},
+	"down": {
+		args:        "[N]",
+		description: "Roll back the N most recently applied migrations, or all of those applied after the -to target, using their paired *.down.sql files.",
+		needsStore:  true,
+		setup: func(flags *flag.FlagSet, _ *options) runFunc {
+			target := flags.String("to", "", "filename or numeric version prefix of the migration to roll back to, it stays applied")
+			return func(ctx context.Context, svc *migrator.Service, args []string) error {
+				if *target != "" {
+					if len(args) != 0 {
+						return fmt.Errorf("expected either -to or the number of migrations to roll back, got both")
+					}
+					return svc.DownToContext(ctx, *target)
+				}
+				if len(args) != 1 {
+					return fmt.Errorf("expected the number of migrations to roll back, got %d arguments", len(args))
+				}
+				steps, err := strconv.Atoi(args[0])
+				if err != nil {
+					return fmt.Errorf("failed to parse number of migrations to roll back: %w", err)
+				}
+				return svc.DownContext(ctx, steps)
+			}
+		},
+	},
+	"status": {
+		description: "List all migrations and whether they are applied, pending, dirty, orphaned, modified or out-of-order.",
+		needsStore:  true,
+		setup: func(flags *flag.FlagSet, _ *options) runFunc {
+			asJSON := flags.Bool("json", false, "print the status report as JSON instead of a table")
+			return func(ctx context.Context, svc *migrator.Service, _ []string) error {
+				report, err := svc.StatusContext(ctx)
+				if err != nil {
+					return err
+				}
+				if *asJSON {
+					encoder := json.NewEncoder(os.Stdout)
+					encoder.SetIndent("", "  ")
+					err = encoder.Encode(report)
+				} else {
+					err = printStatusTable(report)
+				}
+				if err == nil && report.Count(migrator.StateModified) > 0 {
+					err = fmt.Errorf("%w: %d applied migration(s) modified", migrator.ErrChecksumMismatch, report.Count(migrator.StateModified))
+				}
+				return err
+			}
+		},
+	},
+	"redo": {
+		description: "Roll back the most recently applied migration and apply it again.",
+		needsStore:  true,
+		setup: func(_ *flag.FlagSet, _ *options) runFunc {
+			return func(ctx context.Context, svc *migrator.Service, _ []string) error {
+				return svc.RedoContext(ctx)
+			}
+		},
+	},
+	"force": {
+		args:        "FILE",
+		description: "Resolve the dirty migration FILE by marking it completed, or with -retry by marking it to run again.",
+		needsStore:  true,
+		setup: func(flags *flag.FlagSet, _ *options) runFunc {
+			retry := flags.Bool("retry", false, "mark the dirty migration to be retried instead, so that the next run executes it again")
+			yes := flags.Bool("yes", false, "don't ask for confirmation")
+			forcedBy := flags.String("by", currentUser(), "who forces the migration, recorded in the migrations table")
+			return func(ctx context.Context, svc *migrator.Service, args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("expected the filename of the dirty migration, got %d arguments", len(args))
+				}
+
+				mode, action := migrator.ForceCompleted, "Mark the dirty migration %s as completed without running it again?"
+				if *retry {
+					mode, action = migrator.ForceRetry, "Mark the dirty migration %s to be retried, so that the next run executes it again?"
+				}
+				if !*yes && !confirm(fmt.Sprintf(action, args[0])) {
+					return errAborted
+				}
+
+				_, err := svc.ForceContext(ctx, args[0], mode, *forcedBy)
+				return err
+			}
+		},
+	},
+	"accept-checksum": {
+		args:        "FILE",
+		description: "Accept the modified content of the applied migration FILE by recording its new checksum, without running it again.",
+		needsStore:  true,
+		setup: func(_ *flag.FlagSet, _ *options) runFunc {
+			return func(ctx context.Context, svc *migrator.Service, args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("expected the filename of the modified migration, got %d arguments", len(args))
+				}
+				return svc.AcceptChecksumContext(ctx, args[0])
+			}
+		},
+	},
+	"baseline": {
+		args:        "VERSION",
+		description: "Record all migrations up to and including VERSION as applied without running them, to adopt an existing database.",
+		needsStore:  true,
+		setup: func(_ *flag.FlagSet, _ *options) runFunc {
+			return func(ctx context.Context, svc *migrator.Service, args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("expected the filename or version prefix of the last migration to baseline, got %d arguments", len(args))
+				}
+				baselined, err := svc.BaselineContext(ctx, args[0])
+				for _, filename := range baselined {
+					fmt.Println(filename)
+				}
+				return err
+			}
+		},
+	},
+	"create": {
+		args:        "NAME",
+		description: "Create a pair of up/down migration files named after the next free sequence number or the current UTC time.",
+		setup: func(flags *flag.FlagSet, opts *options) runFunc {
+			flags.StringVar(&opts.numbering, "numbering", getEnv("NUMBERING", string(migrator.NumberingSequence)), "version prefix of the new files, sequence or timestamp (env NUMBERING)")
+			flags.StringVar(&opts.templateFile, "template", getEnv("TEMPLATE", ""), "path to a text/template the new files are filled from, empty by default (env TEMPLATE)")
+			return func(_ context.Context, svc *migrator.Service, args []string) error {
+				if len(args) != 1 {
+					return fmt.Errorf("expected the name of the new migration, got %d arguments", len(args))
+				}
+				paths, err := svc.Create(args[0])
+				for _, path := range paths {
+					fmt.Println(path)
+				}
+				return err
+			}
+		},
+	},
+	"validate": {
+		description: "Check the migration files and the migrations table for problems without changing the database.",
+		needsStore:  true,
+		setup: func(_ *flag.FlagSet, _ *options) runFunc {
+			return func(ctx context.Context, svc *migrator.Service, _ []string) error {
+				return svc.ValidateContext(ctx)
+			}
+		},
+	},
+}
+
+var errAborted = errors.New("aborted")
+
+// confirm asks the question on stderr and reports whether it was answered with yes on stdin
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// currentUser returns user@host of whoever runs the binary, as far as it can be determined
+func currentUser() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
+
+func printStatusTable(report migrator.StatusReport) error {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILENAME\tSTATE\tSTARTED AT\tCOMPLETED AT")
+	for _, migration := range report.Migrations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			migration.Filename, migration.State, formatTime(migration.StartedAt), formatTime(migration.CompletedAt))
+	}
+	fmt.Fprintf(w, "\n%d applied, %d pending, %d dirty, %d orphaned, %d modified, %d out-of-order\n",
+		report.Count(migrator.StateApplied), report.Count(migrator.StatePending), report.Count(migrator.StateDirty),
+		report.Count(migrator.StateOrphaned), report.Count(migrator.StateModified), report.Count(migrator.StateOutOfOrder))
+	return w.Flush()
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: litemigrate [command] [flags] [args]\n\nCommands (default: up):\n")
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s %s\t%s\n", name, commands[name].args, commands[name].description)
+	}
+	_ = w.Flush()
+	fmt.Fprintf(os.Stderr, "\nFlags must come before the arguments, e.g. 'litemigrate force -yes 001_foo.sql'. Run\n"+
+		"'litemigrate <command> -h' to list the flags of a command.\n")
+}
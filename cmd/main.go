@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/ymakhloufi/litemigrate/pkg/migrator"
 	"github.com/ymakhloufi/litemigrate/pkg/migrator/store"
@@ -14,21 +19,158 @@ import (
 const defaultMigrationsDir = "./migrations"
 const defaultMigrationsTable = "_migrations"
 
+// options are shared by all commands. Each of them can be set as a flag or as an ENV variable, flags take precedence.
+type options struct {
+	dir             string
+	table           string
+	schema          string
+	driver          string
+	skipDownFiles   bool
+	lockTimeout     time.Duration
+	dryRun          bool
+	allowOutOfOrder bool
+	unversioned     string
+	vars            map[string]string
+	numbering       string
+	templateFile    string
+	tenants         tenantOptions
+	metrics         metricsOptions
+}
+
+func (o *options) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.dir, "dir", getEnv("DIR", defaultMigrationsDir), "path to the folder that contains the migration files (env DIR)")
+	flags.StringVar(&o.table, "table", getEnv("TABLE", defaultMigrationsTable), "name of the table that keeps track of migrations (env TABLE)")
+	flags.StringVar(&o.schema, "schema", getEnv("SCHEMA", ""), "schema of the migrations table, created if missing (env SCHEMA)")
+	flags.StringVar(&o.driver, "driver", getEnv("DRIVER", ""), "database driver to use, postgres, mysql or sqlite (env DRIVER)")
+	flags.BoolVar(&o.skipDownFiles, "skip-down-files", getEnv("SKIP_DOWN_FILES", "false") == "true", "also skip every migration file ending in down.sql, *.down.sql files are always skipped (env SKIP_DOWN_FILES)")
+	flags.BoolVar(&o.allowOutOfOrder, "allow-out-of-order", getEnv("ALLOW_OUT_OF_ORDER", "false") == "true", "apply pending migrations that sort before already applied ones instead of failing (env ALLOW_OUT_OF_ORDER)")
+	flags.StringVar(&o.unversioned, "unversioned", getEnv("UNVERSIONED_FILES", string(migrator.RejectUnversioned)), "what to do with migration files without version prefix, reject or ignore (env UNVERSIONED_FILES)")
+	o.vars = envVars()
+	flags.Func("var", "template variable as key=value, can be repeated (env VAR_<key>)", func(value string) error {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("expected key=value, got %q", value)
+		}
+		o.vars[key] = val
+		return nil
+	})
+	flags.DurationVar(&o.lockTimeout, "lock-timeout", getEnvDuration("LOCK_TIMEOUT", store.DefaultLockTimeout), "how long to wait for another process to release the migration lock, 0 waits forever (env LOCK_TIMEOUT)")
+}
+
+func (o *options) serviceOptions() ([]migrator.Option, error) {
+	var result []migrator.Option
+	if o.dryRun {
+		result = append(result, migrator.WithDryRun(os.Stdout))
+	}
+	if o.allowOutOfOrder {
+		result = append(result, migrator.WithAllowOutOfOrder())
+	}
+	if o.driver == "postgres" {
+		// the splitter only understands postgres syntax, the other drivers get the files as a whole
+		result = append(result, migrator.WithStatementSplitting())
+	}
+	if len(o.vars) > 0 {
+		result = append(result, migrator.WithTemplateVars(o.vars))
+	}
+	if o.unversioned != "" {
+		result = append(result, migrator.WithUnversionedFiles(migrator.UnversionedPolicy(o.unversioned)))
+	}
+	if o.numbering != "" {
+		result = append(result, migrator.WithNumbering(migrator.Numbering(o.numbering)))
+	}
+	if o.templateFile != "" {
+		tmpl, err := os.ReadFile(o.templateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration template: %w", err)
+		}
+		result = append(result, migrator.WithTemplate(string(tmpl)))
+	}
+	return result, nil
+}
+
 func main() {
 	logger, flusher := instantiateLogger()
 	defer flusher()
 
-	migrationStore := instantiateStore(logger)
+	// without a command we run all migrations, which is what the docker image has always done
+	name, args := "up", os.Args[1:]
+	// an empty first argument, e.g. from an unset $CMD in a container spec, means no command
+	if len(args) > 0 && args[0] == "" {
+		args = args[1:]
+	}
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help" || args[0] == "help") {
+		printUsage()
+		return
+	}
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		logger.Fatal("unknown command", zap.String("command", name))
+	}
+
+	opts := &options{}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: litemigrate %s [flags] %s\n\n%s\n\nFlags (must come before the arguments):\n", name, cmd.args, cmd.description)
+		flags.PrintDefaults()
+	}
+	opts.register(flags)
+	run := cmd.setup(flags, opts)
+	_ = flags.Parse(args) // exits on error
+
+	svcOpts, err := opts.serviceOptions()
+	if err != nil {
+		logger.Fatal("invalid options", zap.String("command", name), zap.Error(err))
+	}
+
+	// stop the run on SIGINT/SIGTERM, e.g. when the pod is evicted, instead of being killed halfway through a migration
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.tenants.enabled() {
+		if err := runTenants(ctx, logger, opts, svcOpts, run, flags.Args()); err != nil {
+			logger.Fatal("failed to run command", zap.String("command", name), zap.Error(err))
+		}
+		return
+	}
+
+	if opts.metrics.enabled() {
+		metricsOpt, err := opts.metrics.serviceOption("")
+		if err != nil {
+			logger.Fatal("invalid options", zap.String("command", name), zap.Error(err))
+		}
+		svcOpts = append(svcOpts, metricsOpt)
+	}
 
-	skipDownFiles := getEnv("SKIP_DOWN_FILES", "false") == "true"
-	migrationSvc := migrator.New(logger, migrationStore, getEnv("DIR", defaultMigrationsDir), skipDownFiles)
-	defer migrationSvc.Close()
+	var migrationStore migrator.Store
+	if cmd.needsStore {
+		migrationStore = instantiateStore(logger, opts)
+	}
+	migrationSvc := migrator.New(logger, migrationStore, opts.dir, opts.skipDownFiles, svcOpts...)
+	if cmd.needsStore {
+		defer migrationSvc.Close()
+	}
 
-	err := migrationSvc.Up()
+	err = run(ctx, migrationSvc, flags.Args())
+	writeMetrics(logger, opts) // failed runs are what the metrics are for
 	if err != nil {
-		logger.Fatal("failed to run migrations", zap.Error(err))
+		logger.Fatal("failed to run command", zap.String("command", name), zap.Error(err))
+	}
+}
+
+// writeMetrics writes the metrics if enabled. Failing to do so is logged but doesn't fail the command, whose outcome
+// is already settled.
+func writeMetrics(logger *zap.Logger, opts *options) {
+	if !opts.metrics.enabled() {
+		return
+	}
+	if err := opts.metrics.write(); err != nil {
+		logger.Error("failed to write metrics", zap.Error(err))
 	}
-	logger.Info("migrations completed successfully")
 }
 
 func instantiateLogger() (*zap.Logger, func()) {
@@ -50,25 +192,62 @@ func instantiateLogger() (*zap.Logger, func()) {
 	return logger, flusher
 }
 
-//nolint:staticcheck
-func instantiateStore(logger *zap.Logger) migrator.Store {
-	var err error
-	migrationsTable := getEnv("TABLE", defaultMigrationsTable)
+func instantiateStore(logger *zap.Logger, opts *options) migrator.Store {
+	repo, err := newStore(logger, opts, "")
+	if err != nil {
+		logger.Fatal("failed to instantiate store", zap.String("driver", opts.driver), zap.Error(err))
+	}
+	return repo
+}
 
-	var repo migrator.Store
-	switch driver := getEnv("DRIVER", "-not-set-"); driver {
+// newStore connects to the database. If tenant is set, the store is scoped to the tenant: with postgres, the
+// migrations table lives in the tenant's schema, which is also first on the search_path; with mysql, the tenant is
+// the database the migrations table lives in. SCHEMA is ignored for tenants.
+func newStore(logger *zap.Logger, opts *options, tenant string) (tenantStore, error) {
+	switch opts.driver {
 	case "postgres":
-		connectionString := store.UserAuthConfigFromEnv().ToConnectionString() // user/pass/... from env
-		repo, err = store.NewPostgresStore(logger, migrationsTable, connectionString)
+		cfg, err := storeConfig(opts) // user/pass/... from env
+		if err != nil {
+			return nil, err
+		}
+		cfg.Driver = opts.driver
+		if tenant != "" {
+			cfg.Schema, cfg.SearchPath = tenant, []string{tenant, "public"}
+		}
+		return store.NewPostgresStore(logger, cfg.Table, cfg.ToConnectionString(),
+			store.WithLockTimeout(opts.lockTimeout), store.WithSchema(cfg.Schema))
+	case "mysql":
+		cfg, err := storeConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		if tenant != "" {
+			cfg.DB, cfg.Schema = tenant, tenant
+		}
+		return store.NewMySQLStore(logger, cfg.Table, cfg.ToMySQLDSN(),
+			store.WithLockTimeout(opts.lockTimeout), store.WithSchema(cfg.Schema))
+	case "sqlite":
+		path := getEnv("DB", "")
+		if path == "" {
+			return nil, errors.New("DB must be set to the path of the database file when using sqlite")
+		}
+		if opts.schema != "" || tenant != "" {
+			return nil, errors.New("schemas and tenants are not supported with sqlite")
+		}
+		return store.NewSQLiteStore(opts.table, path)
 	default:
-		logger.Fatal("unknown driver", zap.String("driver", driver))
+		return nil, fmt.Errorf("unknown driver %q", opts.driver)
 	}
+}
 
-	if err != nil || repo == nil {
-		logger.Fatal("failed to instantiate postgres store", zap.Error(err))
+// storeConfig loads the database configuration from the environment, with the table and schema from the flags
+func storeConfig(opts *options) (store.Config, error) {
+	cfg := store.UserAuthConfigFromEnv()
+	cfg.Table, cfg.Schema = opts.table, opts.schema
+	if err := cfg.Validate(); err != nil {
+		return store.Config{}, fmt.Errorf("invalid database configuration: %w", err)
 	}
-
-	return repo
+	return cfg, nil
 }
 
 func getEnv(key, defaultVal string) string {
@@ -78,3 +257,31 @@ func getEnv(key, defaultVal string) string {
 
 	return defaultVal
 }
+
+// envVarPrefix marks ENV variables that are passed to migrations as template variables, e.g. VAR_schema=foo
+const envVarPrefix = "VAR_"
+
+// envVars returns the template variables set as ENV variables, without their prefix
+func envVars() map[string]string {
+	vars := map[string]string{}
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(key, envVarPrefix) && len(key) > len(envVarPrefix) {
+			vars[strings.TrimPrefix(key, envVarPrefix)] = value
+		}
+	}
+	return vars
+}
+
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	val := getEnv(key, "")
+	if val == "" {
+		return defaultVal
+	}
+
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		panic(fmt.Sprintf("invalid duration in %s: %v", key, err))
+	}
+	return duration
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/ymakhloufi/litemigrate/pkg/migrator"
+)
+
+// metricsJob is the job the metrics are pushed to the pushgateway as
+const metricsJob = "litemigrate"
+
+// metricsOptions configure where the metrics of a run end up once it is over, see migrator.Metrics
+type metricsOptions struct {
+	file        string
+	pushgateway string
+	registry    *prometheus.Registry
+}
+
+func (o *metricsOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.file, "metrics-file", getEnv("METRICS_FILE", ""), "file to write prometheus metrics to, e.g. for the node_exporter textfile collector (env METRICS_FILE)")
+	flags.StringVar(&o.pushgateway, "pushgateway-url", getEnv("PUSHGATEWAY_URL", ""), "URL of a prometheus pushgateway to push metrics to (env PUSHGATEWAY_URL)")
+	o.registry = prometheus.NewRegistry()
+}
+
+func (o *metricsOptions) enabled() bool {
+	return o.file != "" || o.pushgateway != ""
+}
+
+// serviceOption returns the option that makes the service record its metrics. If tenant is set, the metrics are
+// labelled with it, so every tenant gets its own series.
+func (o *metricsOptions) serviceOption(tenant string) (migrator.Option, error) {
+	var registerer prometheus.Registerer = o.registry
+	if tenant != "" {
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenant}, o.registry)
+	}
+	metrics, err := migrator.NewMetrics(registerer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+	return migrator.WithMetrics(metrics), nil
+}
+
+// write writes the metrics to the file and pushes them to the pushgateway, whichever are set
+func (o *metricsOptions) write() error {
+	var errs []error
+	if o.file != "" {
+		// writes to a temporary file first, so the collector never reads a half-written file
+		if err := prometheus.WriteToTextfile(o.file, o.registry); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write metrics file: %w", err))
+		}
+	}
+	if o.pushgateway != "" {
+		if err := push.New(o.pushgateway, metricsJob).Gatherer(o.registry).Push(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to push metrics: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ymakhloufi/litemigrate/pkg/migrator"
+	"go.uber.org/zap"
+)
+
+const defaultTenantParallelism = 4
+
+// tenantStore is a store that can also discover tenants with a query
+type tenantStore interface {
+	migrator.Store
+	QueryTenantsContext(ctx context.Context, query string) ([]string, error)
+}
+
+// tenantOptions configure tenant mode, in which a command runs once per tenant, e.g. per postgres schema
+type tenantOptions struct {
+	list        string
+	query       string
+	parallelism int
+}
+
+func (o *tenantOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.list, "tenants", getEnv("TENANTS", ""), "comma-separated schemas (postgres) or databases (mysql) to migrate one by one (env TENANTS)")
+	flags.StringVar(&o.query, "tenants-query", getEnv("TENANTS_QUERY", ""), "query selecting the tenants to migrate, instead of -tenants (env TENANTS_QUERY)")
+	parallelism, err := strconv.Atoi(getEnv("TENANT_PARALLELISM", strconv.Itoa(defaultTenantParallelism)))
+	if err != nil {
+		parallelism = defaultTenantParallelism
+	}
+	flags.IntVar(&o.parallelism, "tenant-parallelism", parallelism, "how many tenants to migrate at once (env TENANT_PARALLELISM)")
+}
+
+func (o *tenantOptions) enabled() bool {
+	return o.list != "" || o.query != ""
+}
+
+// resolve returns the tenants from the list, or those selected by the discovery query
+func (o *tenantOptions) resolve(ctx context.Context, logger *zap.Logger, opts *options) ([]string, error) {
+	if o.list != "" && o.query != "" {
+		return nil, errors.New("either -tenants or -tenants-query can be set, not both")
+	}
+
+	tenants := strings.Split(o.list, ",")
+	if o.query != "" {
+		repo, err := newStore(logger, opts, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to instantiate store: %w", err)
+		}
+		defer func() { _ = repo.Close() }()
+		if tenants, err = repo.QueryTenantsContext(ctx, o.query); err != nil {
+			return nil, fmt.Errorf("failed to discover tenants: %w", err)
+		}
+	}
+
+	result := make([]string, 0, len(tenants))
+	seen := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		tenant = strings.TrimSpace(tenant)
+		if tenant != "" && !seen[tenant] {
+			seen[tenant] = true
+			result = append(result, tenant)
+		}
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no tenants to migrate")
+	}
+	return result, nil
+}
+
+// runTenants runs the command once per tenant, each with its own store and service, and prints a summary. It fails
+// if any of the tenants failed.
+func runTenants(ctx context.Context, logger *zap.Logger, opts *options, svcOpts []migrator.Option, run runFunc, args []string) error {
+	tenants, err := opts.tenants.resolve(ctx, logger, opts)
+	if err != nil {
+		return err
+	}
+	logger.Info("running migrations for tenants", zap.Int("tenants", len(tenants)), zap.Int("parallelism", opts.tenants.parallelism))
+
+	// tenants run in parallel, so each dry run is written to its own buffer and printed as one block afterwards
+	dryRuns := make(map[string]*bytes.Buffer, len(tenants))
+	if opts.dryRun {
+		for _, tenant := range tenants {
+			dryRuns[tenant] = &bytes.Buffer{}
+		}
+	}
+
+	results := migrator.RunTenants(ctx, tenants, opts.tenants.parallelism, func(ctx context.Context, tenant string) error {
+		tenantLogger := logger.With(zap.String("tenant", tenant))
+		tenantOpts := svcOpts[:len(svcOpts):len(svcOpts)]
+		if opts.dryRun {
+			tenantOpts = append(tenantOpts, migrator.WithDryRun(dryRuns[tenant]))
+		}
+		if opts.metrics.enabled() {
+			metricsOpt, err := opts.metrics.serviceOption(tenant)
+			if err != nil {
+				return err
+			}
+			tenantOpts = append(tenantOpts, metricsOpt)
+		}
+		repo, err := newStore(tenantLogger, opts, tenant)
+		if err != nil {
+			return fmt.Errorf("failed to instantiate store: %w", err)
+		}
+		svc := migrator.New(tenantLogger, repo, opts.dir, opts.skipDownFiles, tenantOpts...)
+		defer svc.Close()
+
+		if err := run(ctx, svc, args); err != nil {
+			tenantLogger.Error("failed to run migrations for tenant", zap.Error(err))
+			return err
+		}
+		return nil
+	})
+
+	writeMetrics(logger, opts)
+	for _, tenant := range tenants {
+		if dryRuns[tenant] != nil && dryRuns[tenant].Len() > 0 {
+			fmt.Printf("-- tenant %s\n%s\n", tenant, dryRuns[tenant])
+		}
+	}
+	if err := printTenantSummary(results); err != nil {
+		return err
+	}
+	return results.Err()
+}
+
+func printTenantSummary(results migrator.TenantResults) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tRESULT\tDURATION\tERROR")
+	for _, result := range results {
+		state, errMsg := "ok", ""
+		if result.Err != nil {
+			state, errMsg = "failed", result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Tenant, state, result.Duration.Round(time.Millisecond), errMsg)
+	}
+	fmt.Fprintf(w, "\n%d succeeded, %d failed\n", len(results)-results.Failed(), results.Failed())
+	return w.Flush()
+}
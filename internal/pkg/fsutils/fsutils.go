@@ -1,35 +1,154 @@
 package fsutils
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrReadOnlyFS         = errors.New("can't create files in a read-only file system")
+	ErrUnversionedFile    = errors.New("migration file without version prefix")
+	ErrDuplicateVersion   = errors.New("duplicate migration version")
+	ErrInvalidUnversioned = errors.New("invalid policy for unversioned files")
+)
+
+// versionPrefix matches the numeric or timestamp version prefix of a migration file, e.g. 003 in 003_foo.sql
+var versionPrefix = regexp.MustCompile(`^([0-9]+)[_.-]`)
+
+// Version returns the version of a migration file parsed from its numeric or timestamp prefix, e.g. 3 for
+// 003_foo.sql or 20240131154500 for 20240131154500_foo.sql, along with the prefix as written. ok is false if the
+// filename doesn't start with a version followed by '_', '-' or '.'.
+func Version(filename string) (version uint64, prefix string, ok bool) {
+	match := versionPrefix.FindStringSubmatch(filename)
+	if match == nil {
+		return 0, "", false
+	}
+	version, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return version, match[1], true
+}
+
+// Callback files are run around migrations instead of being migrations themselves
+const (
+	CallbackBeforeAll  = "beforeAll.sql"
+	CallbackBeforeEach = "beforeEach.sql"
+	CallbackAfterEach  = "afterEach.sql"
+	CallbackAfterAll   = "afterAll.sql"
+)
+
+// IsCallback reports whether filename is one of the callback files, e.g. beforeAll.sql
+func IsCallback(filename string) bool {
+	switch filename {
+	case CallbackBeforeAll, CallbackBeforeEach, CallbackAfterEach, CallbackAfterAll:
+		return true
+	}
+	return false
+}
+
+// DownSuffix ends the names of down files rolling back a migration, e.g. 001_foo.down.sql for 001_foo.up.sql
+const DownSuffix = ".down.sql"
+
+// IsDownFile reports whether filename is a down file rolling back a migration, which is never run as a migration
+// itself. Files merely ending in "down.sql", e.g. 003_cooldown.sql, are regular migrations.
+func IsDownFile(filename string) bool {
+	return strings.HasSuffix(filename, DownSuffix)
+}
+
+// RepeatablePrefix starts the names of repeatable migration files, e.g. R__views.sql, which are run again whenever
+// their content changes
+const RepeatablePrefix = "R__"
+
+// IsRepeatable reports whether filename is a repeatable migration file, see RepeatablePrefix
+func IsRepeatable(filename string) bool {
+	return strings.HasPrefix(filename, RepeatablePrefix)
+}
+
+// UnversionedPolicy decides what happens to files that don't start with a version, see Version
+type UnversionedPolicy string
+
+const (
+	// RejectUnversioned makes GetMigrationFileList fail with ErrUnversionedFile
+	RejectUnversioned UnversionedPolicy = "reject"
+	// IgnoreUnversioned makes GetMigrationFileList leave unversioned files out, logging a warning
+	IgnoreUnversioned UnversionedPolicy = "ignore"
 )
 
+// DirElements are sorted by version, files with the same version by name
 type DirElements []os.DirEntry
 
-func (s DirElements) Len() int           { return len(s) }
-func (s DirElements) Less(i, j int) bool { return strings.Compare(s[i].Name(), s[j].Name()) == -1 }
-func (s DirElements) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s DirElements) Len() int      { return len(s) }
+func (s DirElements) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s DirElements) Less(i, j int) bool {
+	vi, _, oki := Version(s[i].Name())
+	vj, _, okj := Version(s[j].Name())
+	if oki != okj {
+		return oki // versioned files first
+	}
+	if vi != vj {
+		return vi < vj
+	}
+	return strings.Compare(s[i].Name(), s[j].Name()) == -1
+}
 
 type FsUtils struct {
+	// SkipDownFiles also leaves out every file ending in "down.sql" in any case, e.g. 002_bar_down.sql. Down files
+	// named like 001_foo.down.sql are always left out.
 	SkipDownFiles bool
+	// Unversioned decides what happens to files without version prefix, RejectUnversioned if empty
+	Unversioned UnversionedPolicy
+	// FS is the file system to read migrations from, e.g. an embed.FS. If nil, the OS file system is used.
+	FS fs.FS
+	// Logger receives warnings about ignored files. If nil, they aren't logged.
+	Logger *zap.Logger
 }
 
 func (s *FsUtils) GetMigrationFileList(dir string) (DirElements, error) {
-	files, err := os.ReadDir(dir)
+	files, err := s.readDir(dir)
 	if err != nil {
 		return nil, err
 	}
 
 	result := DirElements{}
+	versions := map[uint64]string{}
 	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".sql") {
-			if s.SkipDownFiles && strings.HasSuffix(strings.ToLower(file.Name()), "down.sql") {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".sql") || IsCallback(file.Name()) || IsRepeatable(file.Name()) ||
+			IsDownFile(file.Name()) {
+			continue
+		}
+		if s.SkipDownFiles && strings.HasSuffix(strings.ToLower(file.Name()), "down.sql") {
+			continue
+		}
+
+		version, _, ok := Version(file.Name())
+		if !ok {
+			switch s.Unversioned {
+			case "", RejectUnversioned:
+				return nil, fmt.Errorf("%w: %s", ErrUnversionedFile, file.Name())
+			case IgnoreUnversioned:
+				s.logger().Warn("ignoring migration file without version prefix", zap.String("filename", file.Name()))
 				continue
+			default:
+				return nil, fmt.Errorf("%w: %s", ErrInvalidUnversioned, s.Unversioned)
 			}
-			result = append(result, file)
 		}
+
+		if other, exists := versions[version]; exists {
+			return nil, fmt.Errorf("%w: %s and %s", ErrDuplicateVersion, other, file.Name())
+		}
+		versions[version] = file.Name()
+		result = append(result, file)
 	}
 
 	sort.Sort(result)
@@ -37,7 +156,80 @@ func (s *FsUtils) GetMigrationFileList(dir string) (DirElements, error) {
 	return result, nil
 }
 
+// GetCallbackFileList returns the callback files in dir, see IsCallback
+func (s *FsUtils) GetCallbackFileList(dir string) (DirElements, error) {
+	return s.filterFiles(dir, IsCallback)
+}
+
+// GetRepeatableFileList returns the repeatable migration files in dir sorted by name, see IsRepeatable
+func (s *FsUtils) GetRepeatableFileList(dir string) (DirElements, error) {
+	result, err := s.filterFiles(dir, func(filename string) bool {
+		return IsRepeatable(filename) && strings.HasSuffix(filename, ".sql")
+	})
+	sort.Sort(result)
+	return result, err
+}
+
 func (s *FsUtils) ReadFileContent(pathToFile string) (string, error) {
+	if s.FS != nil {
+		rawSQL, err := fs.ReadFile(s.FS, fsPath(pathToFile))
+		return string(rawSQL), err
+	}
+
 	rawSQL, err := os.ReadFile(pathToFile)
 	return string(rawSQL), err
 }
+
+// CreateFile writes content to a new file, failing if the file already exists
+func (s *FsUtils) CreateFile(pathToFile, content string) error {
+	if s.FS != nil {
+		return ErrReadOnlyFS
+	}
+
+	file, err := os.OpenFile(pathToFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.WriteString(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *FsUtils) logger() *zap.Logger {
+	if s.Logger == nil {
+		return zap.NewNop()
+	}
+	return s.Logger
+}
+
+// filterFiles returns the files in dir whose names match
+func (s *FsUtils) filterFiles(dir string, match func(filename string) bool) (DirElements, error) {
+	files, err := s.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := DirElements{}
+	for _, file := range files {
+		if !file.IsDir() && match(file.Name()) {
+			result = append(result, file)
+		}
+	}
+	return result, nil
+}
+
+func (s *FsUtils) readDir(dir string) ([]fs.DirEntry, error) {
+	if s.FS != nil {
+		return fs.ReadDir(s.FS, fsPath(dir))
+	}
+	return os.ReadDir(dir)
+}
+
+// fsPath converts an OS path into the unrooted, slash-separated form that fs.FS expects, e.g. ./migrations/001.sql
+// becomes migrations/001.sql
+func fsPath(osPath string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(osPath)), "/")
+}
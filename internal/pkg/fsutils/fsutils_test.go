@@ -1,9 +1,11 @@
 package fsutils
 
 import (
+	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
+	"testing/fstest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -15,7 +17,9 @@ func TestService_getMigrationFileList(t *testing.T) {
 		existingFiles       []string
 		existingDirectories []string
 		skipDownFlag        bool
+		unversioned         UnversionedPolicy
 		want                []string
+		wantErr             error
 	}{
 		{
 			name: "returns empty list if directory is empty",
@@ -23,19 +27,55 @@ func TestService_getMigrationFileList(t *testing.T) {
 		},
 		{
 			name:          "doesn't return files without .sql suffix",
-			existingFiles: []string{"foo.other", "bar.sql", "baz.sql", "quo.sql.other"},
-			want:          []string{"bar.sql", "baz.sql"},
+			existingFiles: []string{"1_foo.other", "2_bar.sql", "3_baz.sql", "4_quo.sql.other"},
+			want:          []string{"2_bar.sql", "3_baz.sql"},
 		},
 		{
 			name:                "doesn't return folders",
-			existingFiles:       []string{"foo.sql"},
-			existingDirectories: []string{"bar.sql"},
-			want:                []string{"foo.sql"},
+			existingFiles:       []string{"1_foo.sql"},
+			existingDirectories: []string{"2_bar.sql"},
+			want:                []string{"1_foo.sql"},
 		},
 		{
 			name:          "returns files in sorted order",
-			existingFiles: []string{"bbb.sql", "ccc.sql", "aaa.sql", "qqq.sql", "111.sql"},
-			want:          []string{"111.sql", "aaa.sql", "bbb.sql", "ccc.sql", "qqq.sql"},
+			existingFiles: []string{"002_bbb.sql", "003_ccc.sql", "001_aaa.sql", "111.sql", "004-qqq.sql"},
+			want:          []string{"001_aaa.sql", "002_bbb.sql", "003_ccc.sql", "004-qqq.sql", "111.sql"},
+		},
+		{
+			name:          "sorts by version instead of name",
+			existingFiles: []string{"10_x.sql", "9_x.sql", "20240131154500_y.sql", "100_z.sql"},
+			want:          []string{"9_x.sql", "10_x.sql", "100_z.sql", "20240131154500_y.sql"},
+		},
+		{
+			name:          "rejects duplicate versions",
+			existingFiles: []string{"1_foo.sql", "01_bar.sql"},
+			wantErr:       ErrDuplicateVersion,
+		},
+		{
+			name:          "leaves out down files sharing the version of their migration",
+			existingFiles: []string{"1_foo.down.sql", "1_foo.up.sql", "2_bar.sql"},
+			want:          []string{"1_foo.up.sql", "2_bar.sql"},
+		},
+		{
+			name:          "rejects files without version by default",
+			existingFiles: []string{"1_foo.sql", "bar.sql"},
+			wantErr:       ErrUnversionedFile,
+		},
+		{
+			name:          "ignores files without version if configured",
+			existingFiles: []string{"1_foo.sql", "bar.sql", "v2_baz.sql"},
+			unversioned:   IgnoreUnversioned,
+			want:          []string{"1_foo.sql"},
+		},
+		{
+			name:          "leaves out callback files",
+			existingFiles: []string{"1_foo.sql", "beforeAll.sql", "beforeEach.sql", "afterEach.sql", "afterAll.sql"},
+			want:          []string{"1_foo.sql"},
+		},
+		{
+			name:          "leaves out repeatable migration files",
+			existingFiles: []string{"1_foo.sql", "R__views.sql", "R__functions.sql"},
+			want:          []string{"1_foo.sql"},
 		},
 		{
 			name: "skips migrations if skipDownFiles-flag is true",
@@ -59,14 +99,19 @@ func TestService_getMigrationFileList(t *testing.T) {
 				"005_qux.sql",
 			},
 			skipDownFlag: false,
+			// 003_baz.down.sql is the down file of a migration, which is never run as a migration itself
 			want: []string{
 				"001_foo.sql",
 				"002_bar_down.sql",
-				"003_baz.down.sql",
 				"004_quo.DOWN.sql",
 				"005_qux.sql",
 			},
 		},
+		{
+			name:          "doesn't mistake migrations ending in down for down files",
+			existingFiles: []string{"003_cooldown.sql", "004_markdown.sql", "004_markdown.down.sql"},
+			want:          []string{"003_cooldown.sql", "004_markdown.sql"},
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -90,9 +135,12 @@ func TestService_getMigrationFileList(t *testing.T) {
 				require.NoError(t, err)
 			}
 
-			s := &FsUtils{SkipDownFiles: tt.skipDownFlag}
+			s := &FsUtils{SkipDownFiles: tt.skipDownFlag, Unversioned: tt.unversioned}
 			got, err := s.GetMigrationFileList(dir)
-			require.NoError(t, err)
+			require.ErrorIs(t, err, tt.wantErr)
+			if tt.wantErr != nil {
+				return
+			}
 
 			gotStrings := []string{}
 			for _, v := range got {
@@ -103,3 +151,94 @@ func TestService_getMigrationFileList(t *testing.T) {
 		})
 	}
 }
+
+func TestFsUtils_CreateFile(t *testing.T) {
+	t.Parallel()
+
+	pathToFile := filepath.Join(t.TempDir(), "001_foo.up.sql")
+	s := &FsUtils{}
+
+	err := s.CreateFile(pathToFile, "select 1")
+	require.NoError(t, err)
+
+	content, err := s.ReadFileContent(pathToFile)
+	require.NoError(t, err)
+	require.Equal(t, "select 1", content)
+
+	err = s.CreateFile(pathToFile, "select 2")
+	require.ErrorIs(t, err, os.ErrExist)
+}
+
+func TestFsUtils_FS(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"migrations/002_bar.sql":     {Data: []byte("select 2")},
+		"migrations/001_foo.sql":     {Data: []byte("select 1")},
+		"migrations/readme.md":       {Data: []byte("not a migration")},
+		"migrations/nested/003.sql":  {Data: []byte("select 3")},
+		"other_migrations/004_x.sql": {Data: []byte("select 4")},
+	}
+	s := &FsUtils{FS: fsys}
+
+	got, err := s.GetMigrationFileList("./migrations")
+	require.NoError(t, err)
+	gotStrings := []string{}
+	for _, v := range got {
+		gotStrings = append(gotStrings, v.Name())
+	}
+	require.Equal(t, []string{"001_foo.sql", "002_bar.sql"}, gotStrings)
+
+	content, err := s.ReadFileContent(filepath.Join("./migrations", "002_bar.sql"))
+	require.NoError(t, err)
+	require.Equal(t, "select 2", content)
+
+	_, err = s.ReadFileContent("migrations/404.sql")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	err = s.CreateFile("migrations/005_new.sql", "")
+	require.ErrorIs(t, err, ErrReadOnlyFS)
+}
+
+func TestFsUtils_GetCallbackFileList(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"migrations/001_foo.sql":       {Data: []byte("select 1")},
+		"migrations/afterAll.sql":      {Data: []byte("ANALYZE")},
+		"migrations/beforeEach.sql":    {Data: []byte("SET search_path TO app")},
+		"migrations/beforeAll.sql/x":   {Data: []byte("not a callback")},
+		"migrations/afterEveryone.sql": {Data: []byte("not a callback")},
+	}
+	s := &FsUtils{FS: fsys}
+
+	got, err := s.GetCallbackFileList("migrations")
+	require.NoError(t, err)
+	gotStrings := []string{}
+	for _, v := range got {
+		gotStrings = append(gotStrings, v.Name())
+	}
+	require.Equal(t, []string{"afterAll.sql", "beforeEach.sql"}, gotStrings)
+}
+
+func TestFsUtils_GetRepeatableFileList(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"migrations/001_foo.sql":      {Data: []byte("select 1")},
+		"migrations/R__views.sql":     {Data: []byte("CREATE OR REPLACE VIEW v AS SELECT 1")},
+		"migrations/R__functions.sql": {Data: []byte("CREATE OR REPLACE FUNCTION f() ...")},
+		"migrations/R__notes.md":      {Data: []byte("not a migration")},
+		"migrations/r__lowercase.sql": {Data: []byte("not repeatable")},
+		"migrations/R__nested.sql/x":  {Data: []byte("not a file")},
+	}
+	s := &FsUtils{FS: fsys, Unversioned: IgnoreUnversioned}
+
+	got, err := s.GetRepeatableFileList("migrations")
+	require.NoError(t, err)
+	gotStrings := []string{}
+	for _, v := range got {
+		gotStrings = append(gotStrings, v.Name())
+	}
+	require.Equal(t, []string{"R__functions.sql", "R__views.sql"}, gotStrings)
+}
@@ -7,4 +7,20 @@ type Migration struct {
 	Filename    string
 	StartedAt   time.Time
 	CompletedAt *time.Time
+	Checksum    string
+	// ForcedBy and ForcedAt are set if the migration was marked completed by hand after it failed, or was forced to
+	// run again, see AwaitsRetry
+	ForcedBy string
+	ForcedAt *time.Time
+}
+
+// AwaitsRetry reports whether the migration failed and has been forced to run again, i.e. it was forced after it was
+// last started and hasn't been completed since
+func (m Migration) AwaitsRetry() bool {
+	return m.CompletedAt == nil && m.ForcedAt != nil && m.ForcedAt.After(m.StartedAt)
+}
+
+// IsDirty reports whether the migration has been started but never completed, unless it awaits a retry
+func (m Migration) IsDirty() bool {
+	return m.CompletedAt == nil && !m.AwaitsRetry()
 }
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"regexp"
+)
+
+var numberedPlaceholder = regexp.MustCompile(`\$[0-9]+`)
+
+// dialect captures the differences in SQL syntax between the supported databases. Queries in SQLStore are written
+// for postgres and adapted to the dialect where needed.
+type dialect struct {
+	// questionMarks means placeholders are written as ? instead of $1, $2, ...
+	questionMarks bool
+	// now is the expression for the current timestamp
+	now string
+	// returning means INSERT and UPDATE statements support a RETURNING clause
+	returning bool
+	// columnExists is a query selecting whether the table $1 in the schema $3 (the default one if empty) has the column
+	// $2
+	columnExists string
+	// tableExists is a query selecting whether the table $1 exists in the schema $2 (the default one if empty)
+	tableExists string
+	// quote quotes a possibly schema-qualified identifier
+	quote func(parts ...string) string
+}
+
+var (
+	postgresDialect = dialect{
+		now:       "now()",
+		returning: true,
+		columnExists: `SELECT COUNT(*) > 0 FROM information_schema.columns 
+			WHERE table_name = $1 AND column_name = $2 AND table_schema = COALESCE(NULLIF($3, ''), current_schema())`,
+		tableExists: `SELECT COUNT(*) > 0 FROM information_schema.tables 
+			WHERE table_name = $1 AND table_schema = COALESCE(NULLIF($2, ''), current_schema())`,
+		quote: quoteDoubleQuotes,
+	}
+	sqliteDialect = dialect{
+		questionMarks: true,
+		now:           "strftime('%Y-%m-%d %H:%M:%f', 'now')",
+		columnExists: `SELECT COUNT(*) > 0 FROM pragma_table_info 
+			WHERE arg = $1 AND name = $2 AND schema = COALESCE(NULLIF($3, ''), 'main')`,
+		tableExists: `SELECT COUNT(*) > 0 FROM pragma_table_list 
+			WHERE name = $1 AND schema = COALESCE(NULLIF($2, ''), 'main')`,
+		quote: quoteDoubleQuotes,
+	}
+	mysqlDialect = dialect{
+		questionMarks: true,
+		now:           "current_timestamp(6)",
+		columnExists: `SELECT COUNT(*) > 0 FROM information_schema.columns 
+			WHERE table_name = $1 AND column_name = $2 AND table_schema = COALESCE(NULLIF($3, ''), DATABASE())`,
+		tableExists: `SELECT COUNT(*) > 0 FROM information_schema.tables 
+			WHERE table_name = $1 AND table_schema = COALESCE(NULLIF($2, ''), DATABASE())`,
+		quote: quoteBackticks,
+	}
+)
+
+// rebind rewrites the numbered placeholders of a postgres query into the dialect's placeholders. This relies on the
+// placeholders appearing in ascending order, which is the case for all queries in SQLStore.
+func (d dialect) rebind(qry string) string {
+	if !d.questionMarks {
+		return qry
+	}
+	return numberedPlaceholder.ReplaceAllString(qry, "?")
+}
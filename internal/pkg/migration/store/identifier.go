@@ -0,0 +1,56 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrInvalidIdentifier means the name of the migrations table or its schema isn't a plain SQL identifier
+var ErrInvalidIdentifier = errors.New("invalid identifier")
+
+// maxIdentifierLength is the longest identifier postgres accepts without truncating it, mysql allows one more
+const maxIdentifierLength = 63
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateIdentifier makes sure name can be used as the name of the migrations table or its schema, i.e. it starts
+// with a letter or underscore followed by letters, digits and underscores. Names are quoted in queries anyway, this
+// catches typos like "ops._migrations" early.
+func ValidateIdentifier(name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("%w: %q must start with a letter or underscore followed by letters, digits and underscores",
+			ErrInvalidIdentifier, name)
+	}
+	if len(name) > maxIdentifierLength {
+		return fmt.Errorf("%w: %q is longer than %d characters", ErrInvalidIdentifier, name, maxIdentifierLength)
+	}
+	return nil
+}
+
+// quoteDoubleQuotes quotes a possibly schema-qualified identifier the standard way, e.g. "ops"."_migrations"
+func quoteDoubleQuotes(parts ...string) string {
+	return pgx.Identifier(parts).Sanitize()
+}
+
+// QuoteSearchPath returns a postgres search_path listing the schemas in order, each of them quoted so that mixed-case
+// names aren't folded to lower case, e.g. "Tenant_A","public"
+func QuoteSearchPath(schemas ...string) string {
+	quoted := make([]string, len(schemas))
+	for i, schema := range schemas {
+		quoted[i] = quoteDoubleQuotes(schema)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// quoteBackticks quotes a possibly schema-qualified identifier the mysql way, e.g. `ops`.`_migrations`
+func quoteBackticks(parts ...string) string {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = "`" + strings.ReplaceAll(part, "`", "``") + "`"
+	}
+	return strings.Join(quoted, ".")
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIdentifier(t *testing.T) {
+	for _, valid := range []string{"_migrations", "migrations", "Schema_2", strings.Repeat("a", 63)} {
+		require.NoError(t, ValidateIdentifier(valid), valid)
+	}
+	for _, invalid := range []string{"", "ops._migrations", "2fast", "mig-rations", "x; DROP TABLE users", `"quoted"`, "naïve", strings.Repeat("a", 64)} {
+		require.ErrorIs(t, ValidateIdentifier(invalid), ErrInvalidIdentifier, invalid)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	require.Equal(t, `"_migrations"`, quoteDoubleQuotes("_migrations"))
+	require.Equal(t, `"ops"."_migrations"`, quoteDoubleQuotes("ops", "_migrations"))
+	require.Equal(t, `"we""ird"`, quoteDoubleQuotes(`we"ird`))
+	require.Equal(t, "`ops`.`_migrations`", quoteBackticks("ops", "_migrations"))
+	require.Equal(t, "`we``ird`", quoteBackticks("we`ird"))
+	require.Equal(t, `"Tenant_A","public"`, QuoteSearchPath("Tenant_A", "public"))
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultLockTimeout is how long Lock waits for another process to release the migration lock by default
+const DefaultLockTimeout = 15 * time.Minute
+
+// lockPollInterval is how often Lock checks whether the migration lock has been released
+const lockPollInterval = time.Second
+
+var (
+	ErrLockTimeout   = errors.New("timed out waiting for migration lock")
+	ErrAlreadyLocked = errors.New("migration lock already held by this store")
+	ErrNotLocked     = errors.New("migration lock not held by this store")
+)
+
+// sessionLock implements Lock and Unlock on top of a database's session-level named locks. Those locks belong to the
+// connection that took them, so sessionLock holds on to a dedicated connection until the lock is released. The store
+// runs all its queries on that connection meanwhile, see SQLStore.pin.
+type sessionLock struct {
+	logger   *zap.Logger
+	pool     *sql.DB
+	table    string
+	key      int64
+	timeout  time.Duration
+	lockConn *sql.Conn
+
+	// tryAcquire takes the lock without waiting and reports whether it succeeded
+	tryAcquire func(ctx context.Context, conn *sql.Conn, key int64) (bool, error)
+	// release releases the lock and reports whether it was held
+	release func(ctx context.Context, conn *sql.Conn, key int64) (bool, error)
+	// pin is called with the lock's connection once the lock is taken, and with nil once it is released
+	pin func(conn *sql.Conn)
+}
+
+// Lock takes the lock, waiting for another process to release it until the lock timeout has passed
+func (l *sessionLock) Lock() error {
+	return l.LockContext(context.Background())
+}
+
+// LockContext is like Lock, but also stops waiting once ctx is done
+func (l *sessionLock) LockContext(ctx context.Context) error {
+	if l.lockConn != nil {
+		return ErrAlreadyLocked
+	}
+
+	conn, err := l.pool.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	acquired, err := l.tryAcquire(ctx, conn, l.key)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+
+	if !acquired {
+		l.logger.Warn("waiting for another process to release the migration lock",
+			zap.String("table", l.table), zap.Int64("lock_key", l.key), zap.Duration("timeout", l.timeout))
+		if acquired, err = l.wait(ctx, conn); err != nil || !acquired {
+			_ = conn.Close()
+			if err == nil {
+				err = fmt.Errorf("%w after %s", ErrLockTimeout, l.timeout)
+			}
+			return err
+		}
+		l.logger.Info("acquired migration lock", zap.String("table", l.table))
+	}
+
+	l.lockConn = conn
+	l.pin(conn)
+	return nil
+}
+
+func (l *sessionLock) Unlock() error {
+	if l.lockConn == nil {
+		return ErrNotLocked
+	}
+	defer func() {
+		l.pin(nil)
+		_ = l.lockConn.Close()
+		l.lockConn = nil
+	}()
+
+	released, err := l.release(context.Background(), l.lockConn, l.key)
+	if err != nil {
+		return fmt.Errorf("failed to release migration lock: %w", err)
+	}
+	if !released {
+		return ErrNotLocked
+	}
+	return nil
+}
+
+// close releases the lock if it is still held
+func (l *sessionLock) close() {
+	if l.lockConn == nil {
+		return
+	}
+	if err := l.Unlock(); err != nil {
+		l.logger.Error("failed to release migration lock", zap.Error(err))
+	}
+}
+
+// wait polls for the lock until it is acquired or the lock timeout has passed
+func (l *sessionLock) wait(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeout:
+			return false, nil
+		case <-ctx.Done():
+			return false, fmt.Errorf("stopped waiting for migration lock: %w", ctx.Err())
+		case <-ticker.C:
+			acquired, err := l.tryAcquire(ctx, conn, l.key)
+			if err != nil {
+				return false, fmt.Errorf("failed to acquire migration lock: %w", err)
+			}
+			if acquired {
+				return true, nil
+			}
+		}
+	}
+}
+
+// lockKey derives the lock's key from the migrations table name, so that processes using different tables don't
+// block each other
+func lockKey(tableName string) int64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(tableName))
+	return int64(hash.Sum64())
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+)
+
+type MySQLStore struct {
+	SQLStore
+	sessionLock
+}
+
+// NewMySQLStore connects to the MySQL (or MariaDB) server described by dsn, e.g.
+// "user:pass@tcp(localhost:3306)/my_db". parseTime and multiStatements are always enabled, since the store relies on
+// both of them.
+func NewMySQLStore(logger *zap.Logger, migrationTableName, dsn string, opts ...Option) (*MySQLStore, error) {
+	cfg := newConfig(opts)
+	if err := cfg.validate(migrationTableName); err != nil {
+		return nil, err
+	}
+	dsnConfig, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dsn: %w", err)
+	}
+	conn, err := newMySQLConnection(dsnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new mysql connection: %w", err)
+	}
+
+	// mysql's named locks are server-wide, so the lock key is scoped to the database as well
+	store := &MySQLStore{
+		SQLStore: SQLStore{
+			conn:      conn,
+			tableName: migrationTableName,
+			schema:    cfg.schema,
+			dialect:   mysqlDialect},
+		sessionLock: sessionLock{
+			logger:     nopIfNil(logger),
+			pool:       conn,
+			table:      cfg.qualifiedName(migrationTableName),
+			key:        lockKey(dsnConfig.DBName + ":" + cfg.qualifiedName(migrationTableName)),
+			timeout:    cfg.lockTimeout,
+			tryAcquire: mysqlGetLock,
+			release:    mysqlReleaseLock,
+		},
+	}
+	store.sessionLock.pin = store.SQLStore.pin
+	return store, nil
+}
+
+func newMySQLConnection(config *mysql.Config) (*sql.DB, error) {
+	config.ParseTime = true       // scan timestamps into time.Time
+	config.MultiStatements = true // migration files usually contain more than one statement
+
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+func (m *MySQLStore) EnsureMigrationTableExists() error {
+	return m.EnsureMigrationTableExistsContext(context.Background())
+}
+
+func (m *MySQLStore) EnsureMigrationTableExistsContext(ctx context.Context) error {
+	if err := m.ensureSchemaExists(ctx); err != nil {
+		return err
+	}
+
+	qry := `CREATE TABLE IF NOT EXISTS ` + m.quotedTable() + ` (
+		    id int unsigned auto_increment primary key, 
+		    filename varchar(255) unique not null, 
+		    started_at datetime(6) not null default ` + mysqlDialect.now + `, 
+		    completed_at datetime(6),
+		    checksum char(64),
+		    forced_by varchar(255),
+		    forced_at datetime(6)
+		)`
+	if _, err := m.db(ctx).ExecContext(ctx, qry); err != nil {
+		return err
+	}
+
+	// tables created by older versions lack the columns added since
+	return m.addMissingColumns(ctx,
+		column{name: "forced_by", definition: "varchar(255)"},
+		column{name: "forced_at", definition: "datetime(6)"})
+}
+
+// Lock takes a named lock derived from the database and migrations table name, so that only one process at a time
+// runs migrations against it. If another process holds the lock, Lock waits until it is released or the lock timeout
+// has passed. The lock is released by Unlock, or by mysql if the connection dies.
+func (m *MySQLStore) Lock() error {
+	return m.sessionLock.Lock()
+}
+
+func (m *MySQLStore) Close() error {
+	m.sessionLock.close()
+	return m.SQLStore.Close()
+}
+
+// mysqlLockName returns the name of the lock with the given key. It has a fixed length, since mysql rejects names
+// longer than 64 characters.
+func mysqlLockName(key int64) string {
+	return fmt.Sprintf("litemigrate:%016x", uint64(key))
+}
+
+func mysqlGetLock(ctx context.Context, conn *sql.Conn, key int64) (bool, error) {
+	var acquired sql.NullInt64 // 1 if acquired, 0 if held by someone else, NULL on error
+	err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", mysqlLockName(key)).Scan(&acquired)
+	return acquired.Valid && acquired.Int64 == 1, err
+}
+
+func mysqlReleaseLock(ctx context.Context, conn *sql.Conn, key int64) (bool, error) {
+	var released sql.NullInt64 // 1 if released, 0 if held by someone else, NULL if nobody held it
+	err := conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", mysqlLockName(key)).Scan(&released)
+	return released.Valid && released.Int64 == 1, err
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
+)
+
+const mysqlDSN = "myuser:mypass@tcp(127.0.0.1:53306)/mydb"
+
+func makeTestMySQLStore(t *testing.T) *MySQLStore {
+	migrationTableName := "test_migration_" + randomString(16)
+	store, err := NewMySQLStore(nil, migrationTableName, mysqlDSN)
+	require.NoError(t, err)
+
+	require.NoError(t, store.EnsureMigrationTableExists())
+	require.NoError(t, store.EnsureMigrationTableExists()) // must be idempotent
+
+	t.Cleanup(func() {
+		require.NoError(t, store.RawExec("DROP TABLE "+migrationTableName))
+		require.NoError(t, store.Close())
+	})
+
+	return store
+}
+
+func TestMySQLStore_InsertAndMarkMigrationCompleted(t *testing.T) {
+	store := makeTestMySQLStore(t)
+
+	migration, err := store.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+	require.NotZero(t, migration.ID)
+	require.Equal(t, filename, migration.Filename)
+	require.Equal(t, checksum, migration.Checksum)
+	require.NotZero(t, migration.StartedAt)
+	require.Nil(t, migration.CompletedAt)
+
+	hasMigrationRun, err := store.HasMigrationRun(filename)
+	require.NoError(t, err)
+	require.True(t, hasMigrationRun)
+
+	latestFailedMigration, err := store.GetLatestFailedMigration()
+	require.NoError(t, err)
+	require.NotNil(t, latestFailedMigration)
+	require.Equal(t, migration.ID, latestFailedMigration.ID)
+
+	completed, err := store.MarkMigrationCompleted(migration.ID)
+	require.NoError(t, err)
+	require.NotNil(t, completed.CompletedAt)
+
+	migrations, err := store.GetMigrations()
+	require.NoError(t, err)
+	require.Equal(t, []model.Migration{completed}, migrations)
+}
+
+func TestMySQLStore_RawExecMultipleStatements(t *testing.T) {
+	store := makeTestMySQLStore(t)
+	table := store.tableName + "_vets"
+
+	err := store.RawExec(`CREATE TABLE ` + table + ` (name text);
+		INSERT INTO ` + table + ` (name) VALUES ('Jane');`)
+	require.NoError(t, err)
+	require.NoError(t, store.RawExec("DROP TABLE "+table))
+}
+
+func TestMySQLStore_Lock(t *testing.T) {
+	migrationTableName := "test_migration_" + randomString(16)
+	first, err := NewMySQLStore(nil, migrationTableName, mysqlDSN)
+	require.NoError(t, err)
+	second, err := NewMySQLStore(nil, migrationTableName, mysqlDSN, WithLockTimeout(2*lockPollInterval))
+	require.NoError(t, err)
+
+	require.NoError(t, first.Lock())
+	require.ErrorIs(t, first.Lock(), ErrAlreadyLocked)
+	require.ErrorIs(t, second.Lock(), ErrLockTimeout)
+
+	require.NoError(t, first.Unlock())
+	require.ErrorIs(t, first.Unlock(), ErrNotLocked)
+	require.NoError(t, second.Lock())
+	require.NoError(t, second.Unlock())
+
+	require.NoError(t, first.Close())
+	require.NoError(t, second.Close())
+}
+
+func TestMySQLStore_LockName(t *testing.T) {
+	tenantA, err := NewMySQLStore(nil, "_migrations", "u:p@tcp(127.0.0.1:53306)/tenant_with_a_rather_long_database_name_a")
+	require.NoError(t, err)
+	tenantB, err := NewMySQLStore(nil, "_migrations", "u:p@tcp(127.0.0.1:53306)/tenant_with_a_rather_long_database_name_b")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, tenantA.Close())
+		require.NoError(t, tenantB.Close())
+	})
+
+	// mysql rejects lock names longer than 64 characters, and the lock must not be shared between databases
+	require.LessOrEqual(t, len(mysqlLockName(tenantA.key)), 64)
+	require.NotEqual(t, mysqlLockName(tenantA.key), mysqlLockName(tenantB.key))
+}
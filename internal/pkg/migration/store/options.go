@@ -0,0 +1,83 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// config holds the optional settings shared by all stores
+type config struct {
+	lockTimeout time.Duration
+	schema      string
+}
+
+// Option configures optional behaviour of a store
+type Option func(c *config)
+
+// WithLockTimeout sets how long Lock waits for another process to release the migration lock. Zero waits forever.
+// It has no effect on the sqlite store, which doesn't lock.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.lockTimeout = timeout
+	}
+}
+
+// WithSchema puts the migrations table into the given schema, which is created if it doesn't exist yet. Without it,
+// the table lives in the connection's default schema, e.g. the first one on the postgres search_path. With mysql, a
+// schema is a database. It has no effect on the sqlite store.
+func WithSchema(schema string) Option {
+	return func(c *config) {
+		c.schema = schema
+	}
+}
+
+// validate checks the names of the migrations table and its schema
+func (c config) validate(tableName string) error {
+	if err := ValidateIdentifier(tableName); err != nil {
+		return fmt.Errorf("invalid migrations table name: %w", err)
+	}
+	if c.schema == "" {
+		return nil
+	}
+	if err := ValidateIdentifier(c.schema); err != nil {
+		return fmt.Errorf("invalid schema name: %w", err)
+	}
+	return nil
+}
+
+// validateLowercase rejects table names with upper case letters. Older versions didn't quote the table name, so
+// postgres folded e.g. MyMigrations to mymigrations. Quoting it now would switch to a different, empty table and run
+// every migration again.
+func validateLowercase(tableName string) error {
+	if tableName != strings.ToLower(tableName) {
+		return fmt.Errorf("%w: %q contains upper case letters, which postgres used to fold to lower case, use %q",
+			ErrInvalidIdentifier, tableName, strings.ToLower(tableName))
+	}
+	return nil
+}
+
+// qualifiedName returns the unquoted, schema-qualified name of the migrations table, e.g. for deriving lock keys
+func (c config) qualifiedName(tableName string) string {
+	if c.schema == "" {
+		return tableName
+	}
+	return c.schema + "." + tableName
+}
+
+func newConfig(opts []Option) config {
+	c := config{lockTimeout: DefaultLockTimeout}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+func nopIfNil(logger *zap.Logger) *zap.Logger {
+	if logger == nil {
+		return zap.NewNop()
+	}
+	return logger
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -12,9 +13,17 @@ import (
 
 type PostgresStore struct {
 	SQLStore
+	sessionLock
 }
 
-func NewPostgresStore(logger *zap.Logger, migrationTableName, connectionString string) (*PostgresStore, error) {
+func NewPostgresStore(logger *zap.Logger, migrationTableName, connectionString string, opts ...Option) (*PostgresStore, error) {
+	cfg := newConfig(opts)
+	if err := cfg.validate(migrationTableName); err != nil {
+		return nil, err
+	}
+	if err := validateLowercase(migrationTableName); err != nil {
+		return nil, err
+	}
 	conn, err := newPgConnection(logger, connectionString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new postgres connection: %w", err)
@@ -23,8 +32,20 @@ func NewPostgresStore(logger *zap.Logger, migrationTableName, connectionString s
 	store := &PostgresStore{
 		SQLStore: SQLStore{
 			conn:      conn,
-			tableName: migrationTableName},
+			tableName: migrationTableName,
+			schema:    cfg.schema,
+			dialect:   postgresDialect},
+		sessionLock: sessionLock{
+			logger:     nopIfNil(logger),
+			pool:       conn,
+			table:      cfg.qualifiedName(migrationTableName),
+			key:        lockKey(cfg.qualifiedName(migrationTableName)),
+			timeout:    cfg.lockTimeout,
+			tryAcquire: pgTryAdvisoryLock,
+			release:    pgAdvisoryUnlock,
+		},
 	}
+	store.sessionLock.pin = store.SQLStore.pin
 	return store, nil
 }
 
@@ -42,12 +63,54 @@ func newPgConnection(logger *zap.Logger, connectionString string) (conn *sql.DB,
 }
 
 func (pg *PostgresStore) EnsureMigrationTableExists() error {
-	qry := `CREATE TABLE IF NOT EXISTS ` + pg.tableName + ` (
+	return pg.EnsureMigrationTableExistsContext(context.Background())
+}
+
+func (pg *PostgresStore) EnsureMigrationTableExistsContext(ctx context.Context) error {
+	if err := pg.ensureSchemaExists(ctx); err != nil {
+		return err
+	}
+
+	qry := `CREATE TABLE IF NOT EXISTS ` + pg.quotedTable() + ` (
 		    id serial primary key, 
 		    filename text unique not null, 
 		    started_at timestamp not null default now(), 
-		    completed_at timestamp
+		    completed_at timestamp,
+		    checksum text,
+		    forced_by text,
+		    forced_at timestamp
 		)`
-	_, err := pg.conn.Exec(qry)
-	return err
+	if _, err := pg.db(ctx).ExecContext(ctx, qry); err != nil {
+		return err
+	}
+
+	// tables created by older versions lack the columns added since
+	return pg.addMissingColumns(ctx,
+		column{name: "checksum", definition: "text"},
+		column{name: "forced_by", definition: "text"},
+		column{name: "forced_at", definition: "timestamp"})
+}
+
+// Lock takes a session-level advisory lock derived from the migrations table name, so that only one process at a time
+// runs migrations against it. If another process holds the lock, Lock waits until it is released or the lock timeout
+// has passed. The lock is released by Unlock, or by postgres if the connection dies.
+func (pg *PostgresStore) Lock() error {
+	return pg.sessionLock.Lock()
+}
+
+func (pg *PostgresStore) Close() error {
+	pg.sessionLock.close()
+	return pg.SQLStore.Close()
+}
+
+func pgTryAdvisoryLock(ctx context.Context, conn *sql.Conn, key int64) (bool, error) {
+	var acquired bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired)
+	return acquired, err
+}
+
+func pgAdvisoryUnlock(ctx context.Context, conn *sql.Conn, key int64) (bool, error) {
+	var released bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", key).Scan(&released)
+	return released, err
 }
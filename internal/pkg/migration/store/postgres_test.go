@@ -1,7 +1,10 @@
 package store
 
 import (
+	"context"
 	rand2 "crypto/rand"
+	"database/sql"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -16,13 +19,14 @@ var connectionString = fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
 	"myuser", "mypass", "127.0.0.1", 55432, "mydb", "disable")
 
 const filename = "myFileName"
+const checksum = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
 
 func TestPostgresStore_EnsureMigrationTableExists(t *testing.T) {
 	migrationTableName := "test_migration_" + randomString(10)
 	conn, err := newPgConnection(nil, connectionString)
 	require.NoError(t, err)
 
-	store := &PostgresStore{SQLStore: SQLStore{conn: conn, tableName: migrationTableName}}
+	store := &PostgresStore{SQLStore: SQLStore{conn: conn, tableName: migrationTableName, dialect: postgresDialect}}
 
 	_, err = store.GetLatestFailedMigration()
 	require.Error(t, err)
@@ -40,10 +44,11 @@ func TestPostgresStore_EnsureMigrationTableExists(t *testing.T) {
 func TestPostgresStore_InsertMigration(t *testing.T) {
 	pg := makeTestStoreWithEphemeralTable(t)
 
-	migration, err := pg.InsertMigration(filename)
+	migration, err := pg.InsertMigration(filename, checksum)
 	require.NoError(t, err)
 
 	require.Equal(t, filename, migration.Filename)
+	require.Equal(t, checksum, migration.Checksum)
 	require.NotZero(t, migration.ID)
 	require.NotZero(t, migration.StartedAt)
 	require.Nil(t, migration.CompletedAt)
@@ -55,7 +60,7 @@ func TestPostgresStore_InsertMigration(t *testing.T) {
 func TestPostgresStore_MarkMigrationCompleted(t *testing.T) {
 	pg := makeTestStoreWithEphemeralTable(t)
 
-	insertedMigration, err := pg.InsertMigration(filename)
+	insertedMigration, err := pg.InsertMigration(filename, checksum)
 	require.Equal(t, filename, insertedMigration.Filename)
 	require.NoError(t, err)
 
@@ -72,10 +77,51 @@ func TestPostgresStore_MarkMigrationCompleted(t *testing.T) {
 	require.Equal(t, completedMigration, fetchedMigrationAfterCompletion)
 }
 
+func TestPostgresStore_UpdateChecksum(t *testing.T) {
+	pg := makeTestStoreWithEphemeralTable(t)
+
+	migration, err := pg.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+
+	err = pg.UpdateChecksum(migration.ID, "newChecksum")
+	require.NoError(t, err)
+
+	require.Equal(t, "newChecksum", pg.getMigrationByID(t, migration.ID).Checksum)
+}
+
+func TestPostgresStore_EnsureMigrationTableExistsAddsChecksumColumn(t *testing.T) {
+	migrationTableName := "test_migration_" + randomString(16)
+	conn, err := newPgConnection(nil, connectionString)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, err := conn.Exec("DROP TABLE " + migrationTableName)
+		require.NoError(t, err)
+	})
+
+	// the table as created by versions before checksums were recorded
+	_, err = conn.Exec(`CREATE TABLE ` + migrationTableName + ` (
+		id serial primary key, 
+		filename text unique not null, 
+		started_at timestamp not null default now(), 
+		completed_at timestamp
+	)`)
+	require.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO `+migrationTableName+` (filename) VALUES ($1)`, filename)
+	require.NoError(t, err)
+
+	pg := &PostgresStore{SQLStore: SQLStore{conn: conn, tableName: migrationTableName, dialect: postgresDialect}}
+	require.NoError(t, pg.EnsureMigrationTableExists())
+
+	migrations, err := pg.GetMigrations()
+	require.NoError(t, err)
+	require.Len(t, migrations, 1)
+	require.Empty(t, migrations[0].Checksum)
+}
+
 func TestPostgresStore_GetLatestFailedMigration(t *testing.T) {
 	pg := makeTestStoreWithEphemeralTable(t)
 
-	migration, err := pg.InsertMigration("myFileName")
+	migration, err := pg.InsertMigration("myFileName", checksum)
 	require.NoError(t, err)
 
 	latestFailedMigration, err := pg.GetLatestFailedMigration()
@@ -98,7 +144,7 @@ func TestPostgresStore_HasMigrationRun(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, hasMigrationRun)
 
-	_, err = pg.InsertMigration(filename)
+	_, err = pg.InsertMigration(filename, checksum)
 	require.NoError(t, err)
 
 	hasMigrationRun, err = pg.HasMigrationRun(filename)
@@ -106,6 +152,142 @@ func TestPostgresStore_HasMigrationRun(t *testing.T) {
 	require.True(t, hasMigrationRun)
 }
 
+func TestPostgresStore_GetMigrations(t *testing.T) {
+	pg := makeTestStoreWithEphemeralTable(t)
+
+	migrations, err := pg.GetMigrations()
+	require.NoError(t, err)
+	require.Empty(t, migrations)
+
+	first, err := pg.InsertMigration("first", checksum)
+	require.NoError(t, err)
+	first, err = pg.MarkMigrationCompleted(first.ID)
+	require.NoError(t, err)
+	second, err := pg.InsertMigration("second", checksum)
+	require.NoError(t, err)
+
+	migrations, err = pg.GetMigrations()
+	require.NoError(t, err)
+	require.Equal(t, []model.Migration{first, second}, migrations)
+}
+
+func TestPostgresStore_DeleteMigration(t *testing.T) {
+	pg := makeTestStoreWithEphemeralTable(t)
+
+	migration, err := pg.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+
+	err = pg.DeleteMigration(migration.ID)
+	require.NoError(t, err)
+
+	hasMigrationRun, err := pg.HasMigrationRun(filename)
+	require.NoError(t, err)
+	require.False(t, hasMigrationRun)
+}
+
+func TestPostgresStore_Transaction(t *testing.T) {
+	pg := makeTestStoreWithEphemeralTable(t)
+	myErr := errors.New("my error")
+
+	err := pg.ExecTx(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := pg.InsertMigrationContext(ctx, "rolledBack", checksum)
+		require.NoError(t, err)
+		return myErr
+	})
+	require.ErrorIs(t, err, myErr)
+
+	require.NoError(t, pg.ExecTx(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := pg.InsertMigrationContext(ctx, "committed", checksum)
+		return err
+	}))
+
+	hasMigrationRun, err := pg.HasMigrationRun("rolledBack")
+	require.NoError(t, err)
+	require.False(t, hasMigrationRun)
+
+	hasMigrationRun, err = pg.HasMigrationRun("committed")
+	require.NoError(t, err)
+	require.True(t, hasMigrationRun)
+}
+
+func TestPostgresStore_Lock(t *testing.T) {
+	migrationTableName := "test_migration_" + randomString(16)
+	first, err := NewPostgresStore(nil, migrationTableName, connectionString)
+	require.NoError(t, err)
+	second, err := NewPostgresStore(nil, migrationTableName, connectionString, WithLockTimeout(2*lockPollInterval))
+	require.NoError(t, err)
+	other, err := NewPostgresStore(nil, migrationTableName+"_other", connectionString)
+	require.NoError(t, err)
+
+	require.NoError(t, first.Lock())
+	require.ErrorIs(t, first.Lock(), ErrAlreadyLocked)
+	require.ErrorIs(t, second.Lock(), ErrLockTimeout)
+	require.NoError(t, other.Lock()) // different table, different lock
+	require.NoError(t, other.Unlock())
+
+	require.NoError(t, first.Unlock())
+	require.ErrorIs(t, first.Unlock(), ErrNotLocked)
+	require.NoError(t, second.Lock())
+	require.NoError(t, second.Unlock())
+
+	require.NoError(t, first.Close())
+	require.NoError(t, second.Close())
+	require.NoError(t, other.Close())
+}
+
+func TestPostgresStore_LockPinsConnection(t *testing.T) {
+	pg, err := NewPostgresStore(nil, "test_migration_"+randomString(16), connectionString)
+	require.NoError(t, err)
+	backendPID := func(db querier) int {
+		var pid int
+		require.NoError(t, db.QueryRowContext(context.Background(), "SELECT pg_backend_pid()").Scan(&pid))
+		return pid
+	}
+
+	require.NoError(t, pg.Lock())
+	lockPID := backendPID(pg.lockConn)
+	require.Equal(t, lockPID, backendPID(pg.db(context.Background())))
+	require.NoError(t, pg.ExecTx(func(ctx context.Context, tx *sql.Tx) error {
+		require.Equal(t, lockPID, backendPID(pg.db(ctx)))
+		return nil
+	}))
+	require.NoError(t, pg.Unlock())
+	require.Nil(t, pg.pinned)
+
+	require.NoError(t, pg.Close())
+}
+
+func TestPostgresStore_Schema(t *testing.T) {
+	_, err := NewPostgresStore(nil, "_migrations", connectionString, WithSchema("ops;DROP"))
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+	// upper case names used to be folded to lower case, quoting them would switch to another table
+	_, err = NewPostgresStore(nil, "MyMigrations", connectionString)
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+	// schemas weren't supported before, so they keep their case
+	mixedCase, err := NewPostgresStore(nil, "_migrations", connectionString, WithSchema("Tenant_A"))
+	require.NoError(t, err)
+	require.Equal(t, `"Tenant_A"."_migrations"`, mixedCase.quotedTable())
+	require.NoError(t, mixedCase.Close())
+
+	schema := "test_schema_" + randomString(10)
+	pg, err := NewPostgresStore(nil, "_migrations", connectionString, WithSchema(schema))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, err := pg.conn.Exec("DROP SCHEMA " + schema + " CASCADE")
+		require.NoError(t, err)
+		require.NoError(t, pg.Close())
+	})
+
+	require.NoError(t, pg.EnsureMigrationTableExists()) // creates the schema
+	require.NoError(t, pg.EnsureMigrationTableExists())
+	_, err = pg.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+
+	var count int
+	require.NoError(t, pg.conn.QueryRow("SELECT COUNT(*) FROM "+schema+"._migrations").Scan(&count))
+	require.Equal(t, 1, count)
+}
+
 func randomString(length int) string {
 	b := make([]byte, length+2)
 	_, _ = rand2.Read(b)
@@ -118,7 +300,7 @@ func makeTestStoreWithEphemeralTable(t *testing.T) *PostgresStore {
 	conn, err := newPgConnection(nil, connectionString)
 	require.NoError(t, err)
 
-	pg := &PostgresStore{SQLStore: SQLStore{conn: conn, tableName: migrationTableName}}
+	pg := &PostgresStore{SQLStore: SQLStore{conn: conn, tableName: migrationTableName, dialect: postgresDialect}}
 	err = pg.EnsureMigrationTableExists()
 	require.NoError(t, err)
 
@@ -131,10 +313,7 @@ func makeTestStoreWithEphemeralTable(t *testing.T) *PostgresStore {
 }
 
 func (pg *PostgresStore) getMigrationByID(t *testing.T, id uint) model.Migration {
-	var migration model.Migration
-	err := pg.conn.
-		QueryRow("SELECT id, filename, started_at, completed_at FROM "+pg.tableName+" WHERE id = $1", id).
-		Scan(&migration.ID, &migration.Filename, &migration.StartedAt, &migration.CompletedAt)
+	migration, err := pg.getMigration(context.Background(), id)
 
 	require.NoError(t, err)
 
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite" // registers the pure-Go "sqlite" driver
+)
+
+type SQLiteStore struct {
+	SQLStore
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database file at path
+func NewSQLiteStore(migrationTableName, path string) (*SQLiteStore, error) {
+	if err := ValidateIdentifier(migrationTableName); err != nil {
+		return nil, fmt.Errorf("invalid migrations table name: %w", err)
+	}
+	conn, err := newSQLiteConnection(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new sqlite connection: %w", err)
+	}
+
+	store := &SQLiteStore{
+		SQLStore: SQLStore{
+			conn:      conn,
+			tableName: migrationTableName,
+			dialect:   sqliteDialect},
+	}
+	return store, nil
+}
+
+func newSQLiteConnection(path string) (*sql.DB, error) {
+	// wait for other connections to release their locks instead of failing right away
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {"busy_timeout(5000)"}}.Encode()
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite only allows a single writer at a time, sharing one connection keeps transactions from locking each other out
+	conn.SetMaxOpenConns(1)
+	return conn, conn.Ping()
+}
+
+func (s *SQLiteStore) EnsureMigrationTableExists() error {
+	return s.EnsureMigrationTableExistsContext(context.Background())
+}
+
+func (s *SQLiteStore) EnsureMigrationTableExistsContext(ctx context.Context) error {
+	qry := `CREATE TABLE IF NOT EXISTS ` + s.quotedTable() + ` (
+		    id integer primary key autoincrement, 
+		    filename text unique not null, 
+		    started_at timestamp not null default (` + sqliteDialect.now + `), 
+		    completed_at timestamp,
+		    checksum text,
+		    forced_by text,
+		    forced_at timestamp
+		)`
+	if _, err := s.db(ctx).ExecContext(ctx, qry); err != nil {
+		return err
+	}
+
+	// tables created by older versions lack the columns added since
+	return s.addMissingColumns(ctx,
+		column{name: "forced_by", definition: "text"},
+		column{name: "forced_at", definition: "timestamp"})
+}
+
+// Lock is a no-op: sqlite has no advisory locks, and only a single process at a time can write to the database file
+// anyway. Concurrent runs are serialized on the database file by sqlite itself.
+func (s *SQLiteStore) Lock() error {
+	return nil
+}
+
+// LockContext is a no-op, see Lock
+func (s *SQLiteStore) LockContext(_ context.Context) error {
+	return nil
+}
+
+// Unlock is a no-op, see Lock
+func (s *SQLiteStore) Unlock() error {
+	return nil
+}
@@ -0,0 +1,304 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
+)
+
+func makeTestSQLiteStore(t *testing.T) *SQLiteStore {
+	store, err := NewSQLiteStore("_migrations", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, store.Close()) })
+
+	require.NoError(t, store.EnsureMigrationTableExists())
+	require.NoError(t, store.EnsureMigrationTableExists()) // must be idempotent
+
+	return store
+}
+
+func TestSQLiteStore_MigrationTableExists(t *testing.T) {
+	store, err := NewSQLiteStore("_migrations", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, store.Close()) })
+
+	exists, err := store.MigrationTableExists()
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, store.EnsureMigrationTableExists())
+	exists, err = store.MigrationTableExists()
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestSQLiteStore_MigrationTableExistsBeforeUpgrade(t *testing.T) {
+	store, err := NewSQLiteStore("_migrations", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, store.Close()) })
+
+	// as created by a version without the forced_by and forced_at columns
+	require.NoError(t, store.RawExec(`CREATE TABLE "_migrations" (
+		id integer primary key autoincrement,
+		filename text unique not null,
+		started_at timestamp not null default (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+		completed_at timestamp,
+		checksum text
+	)`))
+	require.NoError(t, store.RawExec(`INSERT INTO "_migrations" (filename, checksum) VALUES ('1_foo.sql', 'abc')`))
+
+	exists, err := store.MigrationTableExists()
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// the table can be read as it is, without adding the missing columns
+	migrations, err := store.GetMigrations()
+	require.NoError(t, err)
+	require.Len(t, migrations, 1)
+	require.Equal(t, "abc", migrations[0].Checksum)
+	require.Empty(t, migrations[0].ForcedBy)
+	require.Nil(t, migrations[0].ForcedAt)
+	failed, err := store.GetLatestFailedMigration()
+	require.NoError(t, err)
+	require.Equal(t, "1_foo.sql", failed.Filename)
+	hasColumn, err := store.columnExists(context.Background(), "forced_by")
+	require.NoError(t, err)
+	require.False(t, hasColumn)
+
+	require.NoError(t, store.EnsureMigrationTableExists())
+	forced, err := store.MarkMigrationForced(migrations[0].ID, "jane@laptop")
+	require.NoError(t, err)
+	require.Equal(t, "jane@laptop", forced.ForcedBy)
+}
+
+func TestSQLiteStore_InsertAndMarkMigrationCompleted(t *testing.T) {
+	store := makeTestSQLiteStore(t)
+
+	migration, err := store.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+	require.NotZero(t, migration.ID)
+	require.Equal(t, filename, migration.Filename)
+	require.Equal(t, checksum, migration.Checksum)
+	require.NotZero(t, migration.StartedAt)
+	require.Nil(t, migration.CompletedAt)
+
+	latestFailedMigration, err := store.GetLatestFailedMigration()
+	require.NoError(t, err)
+	require.NotNil(t, latestFailedMigration)
+	require.Equal(t, migration.ID, latestFailedMigration.ID)
+
+	completed, err := store.MarkMigrationCompleted(migration.ID)
+	require.NoError(t, err)
+	require.NotNil(t, completed.CompletedAt)
+	require.False(t, completed.CompletedAt.Before(completed.StartedAt))
+
+	latestFailedMigration, err = store.GetLatestFailedMigration()
+	require.NoError(t, err)
+	require.Nil(t, latestFailedMigration)
+
+	migrations, err := store.GetMigrations()
+	require.NoError(t, err)
+	require.Equal(t, []model.Migration{completed}, migrations)
+}
+
+func TestSQLiteStore_HasMigrationRun(t *testing.T) {
+	store := makeTestSQLiteStore(t)
+
+	hasMigrationRun, err := store.HasMigrationRun(filename)
+	require.NoError(t, err)
+	require.False(t, hasMigrationRun)
+
+	migration, err := store.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+
+	hasMigrationRun, err = store.HasMigrationRun(filename)
+	require.NoError(t, err)
+	require.True(t, hasMigrationRun)
+
+	require.NoError(t, store.DeleteMigration(migration.ID))
+
+	hasMigrationRun, err = store.HasMigrationRun(filename)
+	require.NoError(t, err)
+	require.False(t, hasMigrationRun)
+}
+
+func TestSQLiteStore_UpdateChecksum(t *testing.T) {
+	store := makeTestSQLiteStore(t)
+
+	migration, err := store.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+	require.NoError(t, store.UpdateChecksum(migration.ID, "newChecksum"))
+
+	migration, err = store.getMigration(context.Background(), migration.ID)
+	require.NoError(t, err)
+	require.Equal(t, "newChecksum", migration.Checksum)
+}
+
+func TestSQLiteStore_Transaction(t *testing.T) {
+	store := makeTestSQLiteStore(t)
+	myErr := errors.New("my error")
+
+	err := store.ExecTx(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := store.InsertMigrationContext(ctx, "rolledBack", checksum)
+		require.NoError(t, err)
+		require.NoError(t, store.RawExecContext(ctx, "CREATE TABLE rolled_back (id integer)"))
+		return myErr
+	})
+	require.ErrorIs(t, err, myErr)
+
+	require.NoError(t, store.ExecTx(func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := store.InsertMigrationContext(ctx, "committed", checksum); err != nil {
+			return err
+		}
+		return store.RawExecContext(ctx, "CREATE TABLE committed (id integer); INSERT INTO committed VALUES (1);")
+	}))
+
+	migrations, err := store.GetMigrations()
+	require.NoError(t, err)
+	require.Len(t, migrations, 1)
+	require.Equal(t, "committed", migrations[0].Filename)
+
+	require.Error(t, store.RawExec("SELECT * FROM rolled_back"))
+	require.NoError(t, store.RawExec("SELECT * FROM committed"))
+}
+
+func TestSQLiteStore_Context(t *testing.T) {
+	store := makeTestSQLiteStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, store.RawExecContext(ctx, "CREATE TABLE cancelled (id integer)"), context.Canceled)
+	_, err := store.InsertMigrationContext(ctx, filename, checksum)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// cancelling the context of a transaction rolls it back
+	ctx, cancel = context.WithCancel(context.Background())
+	err = store.ExecTxContext(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := store.InsertMigrationContext(ctx, filename, checksum)
+		require.NoError(t, err)
+		cancel()
+		return nil
+	})
+	require.Error(t, err)
+
+	hasMigrationRun, err := store.HasMigrationRun(filename)
+	require.NoError(t, err)
+	require.False(t, hasMigrationRun)
+}
+
+func TestSQLiteStore_MarkMigrationForced(t *testing.T) {
+	store, err := NewSQLiteStore("_migrations", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, store.Close()) })
+
+	// the table as created by versions before forced migrations were recorded
+	require.NoError(t, store.RawExec(`CREATE TABLE _migrations (
+		id integer primary key autoincrement, 
+		filename text unique not null, 
+		started_at timestamp not null default (strftime('%Y-%m-%d %H:%M:%f', 'now')), 
+		completed_at timestamp,
+		checksum text
+	)`))
+	require.NoError(t, store.EnsureMigrationTableExists())
+	require.NoError(t, store.EnsureMigrationTableExists()) // must be idempotent
+
+	migration, err := store.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+	require.Empty(t, migration.ForcedBy)
+	require.Nil(t, migration.ForcedAt)
+
+	forced, err := store.MarkMigrationForced(migration.ID, "jane@laptop")
+	require.NoError(t, err)
+	require.NotNil(t, forced.CompletedAt)
+	require.NotNil(t, forced.ForcedAt)
+	require.Equal(t, "jane@laptop", forced.ForcedBy)
+}
+
+func TestSQLiteStore_MarkMigrationForRetry(t *testing.T) {
+	store := makeTestSQLiteStore(t)
+
+	migration, err := store.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+	dirty, err := store.GetLatestFailedMigration()
+	require.NoError(t, err)
+	require.NotNil(t, dirty)
+
+	time.Sleep(5 * time.Millisecond) // timestamps have millisecond precision
+	forced, err := store.MarkMigrationForRetry(migration.ID, "jane@laptop")
+	require.NoError(t, err)
+	require.Nil(t, forced.CompletedAt)
+	require.Equal(t, "jane@laptop", forced.ForcedBy)
+	require.True(t, forced.AwaitsRetry())
+	dirty, err = store.GetLatestFailedMigration()
+	require.NoError(t, err)
+	require.Nil(t, dirty, "a migration awaiting a retry isn't dirty")
+
+	// once it runs again, it is dirty until it completes
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, store.RestartMigration(migration.ID))
+	dirty, err = store.GetLatestFailedMigration()
+	require.NoError(t, err)
+	require.NotNil(t, dirty)
+
+	completed, err := store.MarkMigrationCompleted(migration.ID)
+	require.NoError(t, err)
+	require.NotNil(t, completed.CompletedAt)
+	require.Equal(t, "jane@laptop", completed.ForcedBy)
+	require.Equal(t, forced.ForcedAt, completed.ForcedAt)
+}
+
+func TestSQLiteStore_ExecTx(t *testing.T) {
+	store := makeTestSQLiteStore(t)
+	myErr := errors.New("my error")
+
+	err := store.ExecTx(func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "CREATE TABLE vets (name text)")
+		require.NoError(t, err)
+		// transactions don't nest
+		require.ErrorIs(t, store.ExecTxContext(ctx, func(ctx context.Context, tx *sql.Tx) error { return nil }),
+			ErrTransactionInProgress)
+		return myErr
+	})
+	require.ErrorIs(t, err, myErr)
+	require.NoError(t, store.RawExec("CREATE TABLE vets (name text)")) // the first one has been rolled back
+}
+
+func TestSQLiteStore_QuotedTableName(t *testing.T) {
+	_, err := NewSQLiteStore("ops._migrations", filepath.Join(t.TempDir(), "test.db"))
+	require.ErrorIs(t, err, ErrInvalidIdentifier)
+
+	// a reserved word only works as a table name if it is quoted
+	store, err := NewSQLiteStore("order", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, store.Close()) })
+	require.NoError(t, store.EnsureMigrationTableExists())
+	require.NoError(t, store.EnsureMigrationTableExists())
+
+	migration, err := store.InsertMigration(filename, checksum)
+	require.NoError(t, err)
+	_, err = store.MarkMigrationCompleted(migration.ID)
+	require.NoError(t, err)
+
+	migrations, err := store.GetMigrations()
+	require.NoError(t, err)
+	require.Len(t, migrations, 1)
+}
+
+func TestSQLiteStore_QueryTenants(t *testing.T) {
+	store := makeTestSQLiteStore(t)
+	require.NoError(t, store.RawExec(`CREATE TABLE tenants (name text, active bool);
+		INSERT INTO tenants VALUES ('tenant_a', true), ('tenant_b', false), ('tenant_c', true);`))
+
+	tenants, err := store.QueryTenantsContext(context.Background(), "SELECT name FROM tenants WHERE active ORDER BY name")
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant_a", "tenant_c"}, tenants)
+
+	_, err = store.QueryTenantsContext(context.Background(), "SELECT name, active FROM tenants")
+	require.Error(t, err)
+}
@@ -1,15 +1,158 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 
 	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
 )
 
+// ErrTransactionInProgress means ExecTxContext was called with the context of a transaction it started before
+var ErrTransactionInProgress = errors.New("transaction already in progress")
+
+// querier is implemented by *sql.DB, *sql.Conn and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// optionalColumns are the columns of the migrations table that tables created by older versions may lack, until
+// EnsureMigrationTableExists adds them
+var optionalColumns = []string{"checksum", "forced_by", "forced_at"}
+
 type SQLStore struct {
-	conn      *sql.DB
+	conn *sql.DB
+	// pinned is the connection holding the migration lock, if any. All queries run on it while the lock is held, so
+	// that session settings, e.g. made by callbacks, apply to the whole run.
+	pinned    *sql.Conn
 	tableName string
+	// schema is the schema of the migrations table, the connection's default schema if empty
+	schema  string
+	dialect dialect
+	// missingColumns are the optional columns the migrations table lacks, which are read as empty
+	missingColumns map[string]bool
+}
+
+// optionalColumn returns the name of an optional column for use in queries, or NULL if the migrations table lacks it
+func (s *SQLStore) optionalColumn(name string) string {
+	if s.missingColumns[name] {
+		return "NULL"
+	}
+	return name
+}
+
+// migrationColumns returns the columns selected to scan a model.Migration with scanMigration
+func (s *SQLStore) migrationColumns() string {
+	return `id, filename, started_at, completed_at, COALESCE(` + s.optionalColumn("checksum") + `, ''), COALESCE(` +
+		s.optionalColumn("forced_by") + `, ''), ` + s.optionalColumn("forced_at")
+}
+
+// quotedTable returns the quoted, schema-qualified name of the migrations table for use in queries
+func (s *SQLStore) quotedTable() string {
+	if s.schema == "" {
+		return s.dialect.quote(s.tableName)
+	}
+	return s.dialect.quote(s.schema, s.tableName)
+}
+
+// ensureSchemaExists creates the schema of the migrations table, if one is set and it doesn't exist yet
+func (s *SQLStore) ensureSchemaExists(ctx context.Context) error {
+	if s.schema == "" {
+		return nil
+	}
+	if _, err := s.db(ctx).ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+s.dialect.quote(s.schema)); err != nil {
+		return fmt.Errorf("failed to create schema %s: %w", s.schema, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) MigrationTableExists() (bool, error) {
+	return s.MigrationTableExistsContext(context.Background())
+}
+
+// MigrationTableExistsContext reports whether the migrations table exists, without creating it or its schema. If the
+// table was created by an older version, the columns it lacks are read as empty until EnsureMigrationTableExists adds
+// them, so the table can be read without changing it.
+func (s *SQLStore) MigrationTableExistsContext(ctx context.Context) (bool, error) {
+	var exists bool
+	err := s.db(ctx).QueryRowContext(ctx, s.dialect.rebind(s.dialect.tableExists), s.tableName, s.schema).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check whether table %s exists: %w", s.tableName, err)
+	}
+	if !exists {
+		return false, nil
+	}
+
+	missing := map[string]bool{}
+	for _, name := range optionalColumns {
+		exists, err := s.columnExists(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			missing[name] = true
+		}
+	}
+	s.missingColumns = missing
+	return true, nil
+}
+
+// txKey is the context key of the transaction ExecTxContext started on the given store
+type txKey struct{ store *SQLStore }
+
+// db returns the transaction ctx carries, if any, or else the pinned connection, or else the connection pool
+func (s *SQLStore) db(ctx context.Context) querier {
+	if tx, ok := ctx.Value(txKey{s}).(*sql.Tx); ok {
+		return tx
+	}
+	if s.pinned != nil {
+		return s.pinned
+	}
+	return s.conn
+}
+
+// pin makes all following queries run on conn, until pin is called with nil
+func (s *SQLStore) pin(conn *sql.Conn) {
+	s.pinned = conn
+}
+
+// ExecTx runs fn in a new transaction, see ExecTxContext
+func (s *SQLStore) ExecTx(fn func(ctx context.Context, tx *sql.Tx) error) error {
+	return s.ExecTxContext(context.Background(), fn)
+}
+
+// ExecTxContext runs fn in a new transaction, which is committed if fn succeeds and rolled back otherwise, also if ctx
+// is cancelled before. The store's methods run in the transaction as well when they are called with the context passed
+// to fn, e.g. to record a migration along with running it.
+func (s *SQLStore) ExecTxContext(ctx context.Context, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	if _, ok := ctx.Value(txKey{s}).(*sql.Tx); ok {
+		return ErrTransactionInProgress
+	}
+
+	var tx *sql.Tx
+	var err error
+	if s.pinned != nil {
+		tx, err = s.pinned.BeginTx(ctx, nil)
+	} else {
+		tx, err = s.conn.BeginTx(ctx, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if err := fn(context.WithValue(ctx, txKey{s}, tx), tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			return errors.Join(err, fmt.Errorf("failed to roll back transaction: %w", rollbackErr))
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
 }
 
 func (s *SQLStore) Close() error {
@@ -17,12 +160,16 @@ func (s *SQLStore) Close() error {
 }
 
 func (s *SQLStore) HasMigrationRun(filename string) (bool, error) {
+	return s.HasMigrationRunContext(context.Background(), filename)
+}
+
+func (s *SQLStore) HasMigrationRunContext(ctx context.Context, filename string) (bool, error) {
 	qry := `SELECT EXISTS (
     			SELECT 1 
-    			FROM ` + s.tableName + ` 
+    			FROM ` + s.quotedTable() + ` 
     			WHERE filename = $1
     		)`
-	row := s.conn.QueryRow(qry, filename)
+	row := s.db(ctx).QueryRowContext(ctx, s.dialect.rebind(qry), filename)
 
 	var exists bool
 	err := row.Scan(&exists)
@@ -33,36 +180,153 @@ func (s *SQLStore) HasMigrationRun(filename string) (bool, error) {
 	return exists, nil
 }
 
-func (s *SQLStore) InsertMigration(filename string) (model.Migration, error) {
-	qry := `INSERT INTO ` + s.tableName + ` (filename) 
-		VALUES ($1) 
-		RETURNING id, filename, started_at, completed_at`
-	row := s.conn.QueryRow(qry, filename)
+func (s *SQLStore) InsertMigration(filename, checksum string) (model.Migration, error) {
+	return s.InsertMigrationContext(context.Background(), filename, checksum)
+}
+
+func (s *SQLStore) InsertMigrationContext(ctx context.Context, filename, checksum string) (model.Migration, error) {
+	qry := `INSERT INTO ` + s.quotedTable() + ` (filename, checksum) 
+		VALUES ($1, $2)`
+	if s.dialect.returning {
+		return scanMigration(s.db(ctx).QueryRowContext(ctx, qry+` RETURNING `+s.migrationColumns(), filename, checksum))
+	}
 
-	result := model.Migration{}
-	err := row.Scan(&result.ID, &result.Filename, &result.StartedAt, &result.CompletedAt)
-	return result, err
+	result, err := s.db(ctx).ExecContext(ctx, s.dialect.rebind(qry), filename, checksum)
+	if err != nil {
+		return model.Migration{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return model.Migration{}, err
+	}
+	return s.getMigration(ctx, uint(id))
 }
 
 func (s *SQLStore) MarkMigrationCompleted(id uint) (model.Migration, error) {
-	qry := `UPDATE ` + s.tableName + `
-		SET completed_at = now() 
-		WHERE id = $1
-		RETURNING id, filename, started_at, completed_at`
-	row := s.conn.QueryRow(qry, id)
+	return s.MarkMigrationCompletedContext(context.Background(), id)
+}
 
-	result := model.Migration{}
-	err := row.Scan(&result.ID, &result.Filename, &result.StartedAt, &result.CompletedAt)
-	return result, err
+func (s *SQLStore) MarkMigrationCompletedContext(ctx context.Context, id uint) (model.Migration, error) {
+	qry := `UPDATE ` + s.quotedTable() + `
+		SET completed_at = ` + s.dialect.now + ` 
+		WHERE id = $1`
+	if s.dialect.returning {
+		return scanMigration(s.db(ctx).QueryRowContext(ctx, qry+` RETURNING `+s.migrationColumns(), id))
+	}
+
+	if _, err := s.db(ctx).ExecContext(ctx, s.dialect.rebind(qry), id); err != nil {
+		return model.Migration{}, err
+	}
+	return s.getMigration(ctx, id)
+}
+
+func (s *SQLStore) MarkMigrationForced(id uint, forcedBy string) (model.Migration, error) {
+	return s.MarkMigrationForcedContext(context.Background(), id, forcedBy)
+}
+
+// MarkMigrationForcedContext marks a dirty migration as completed by hand, recording who did it and when
+func (s *SQLStore) MarkMigrationForcedContext(ctx context.Context, id uint, forcedBy string) (model.Migration, error) {
+	qry := `UPDATE ` + s.quotedTable() + `
+		SET completed_at = ` + s.dialect.now + `, forced_at = ` + s.dialect.now + `, forced_by = $1 
+		WHERE id = $2`
+	if s.dialect.returning {
+		return scanMigration(s.db(ctx).QueryRowContext(ctx, qry+` RETURNING `+s.migrationColumns(), forcedBy, id))
+	}
+
+	if _, err := s.db(ctx).ExecContext(ctx, s.dialect.rebind(qry), forcedBy, id); err != nil {
+		return model.Migration{}, err
+	}
+	return s.getMigration(ctx, id)
+}
+
+func (s *SQLStore) MarkMigrationForRetry(id uint, forcedBy string) (model.Migration, error) {
+	return s.MarkMigrationForRetryContext(context.Background(), id, forcedBy)
+}
+
+// MarkMigrationForRetryContext records who forced a dirty migration to run again and when, so that it is no longer
+// dirty but awaits a retry, see model.Migration.AwaitsRetry
+func (s *SQLStore) MarkMigrationForRetryContext(ctx context.Context, id uint, forcedBy string) (model.Migration, error) {
+	qry := `UPDATE ` + s.quotedTable() + `
+		SET forced_at = ` + s.dialect.now + `, forced_by = $1 
+		WHERE id = $2`
+	if s.dialect.returning {
+		return scanMigration(s.db(ctx).QueryRowContext(ctx, qry+` RETURNING `+s.migrationColumns(), forcedBy, id))
+	}
+
+	if _, err := s.db(ctx).ExecContext(ctx, s.dialect.rebind(qry), forcedBy, id); err != nil {
+		return model.Migration{}, err
+	}
+	return s.getMigration(ctx, id)
+}
+
+func (s *SQLStore) RestartMigration(id uint) error {
+	return s.RestartMigrationContext(context.Background(), id)
+}
+
+// RestartMigrationContext marks a migration that runs again, e.g. after it was forced to, as started now and not
+// completed, so that it is dirty if it fails again
+func (s *SQLStore) RestartMigrationContext(ctx context.Context, id uint) error {
+	qry := `UPDATE ` + s.quotedTable() + ` SET started_at = ` + s.dialect.now + `, completed_at = NULL WHERE id = $1`
+	_, err := s.db(ctx).ExecContext(ctx, s.dialect.rebind(qry), id)
+	return err
+}
+
+func (s *SQLStore) UpdateChecksum(id uint, checksum string) error {
+	return s.UpdateChecksumContext(context.Background(), id, checksum)
+}
+
+func (s *SQLStore) UpdateChecksumContext(ctx context.Context, id uint, checksum string) error {
+	qry := `UPDATE ` + s.quotedTable() + ` SET checksum = $1 WHERE id = $2`
+	_, err := s.db(ctx).ExecContext(ctx, s.dialect.rebind(qry), checksum, id)
+	return err
+}
+
+func (s *SQLStore) GetMigrations() ([]model.Migration, error) {
+	return s.GetMigrationsContext(context.Background())
+}
+
+func (s *SQLStore) GetMigrationsContext(ctx context.Context) ([]model.Migration, error) {
+	qry := `SELECT ` + s.migrationColumns() + ` 
+		FROM ` + s.quotedTable() + `
+		ORDER BY id ASC`
+	rows, err := s.db(ctx).QueryContext(ctx, qry)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	result := []model.Migration{}
+	for rows.Next() {
+		migration, err := scanMigration(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, migration)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLStore) DeleteMigration(id uint) error {
+	return s.DeleteMigrationContext(context.Background(), id)
+}
+
+func (s *SQLStore) DeleteMigrationContext(ctx context.Context, id uint) error {
+	qry := `DELETE FROM ` + s.quotedTable() + ` WHERE id = $1`
+	_, err := s.db(ctx).ExecContext(ctx, s.dialect.rebind(qry), id)
+	return err
 }
 
 func (s *SQLStore) GetLatestFailedMigration() (*model.Migration, error) {
+	return s.GetLatestFailedMigrationContext(context.Background())
+}
+
+func (s *SQLStore) GetLatestFailedMigrationContext(ctx context.Context) (*model.Migration, error) {
 	qry := `SELECT id, filename, started_at 
-		FROM ` + s.tableName + `
-		WHERE completed_at IS NULL 
+		FROM ` + s.quotedTable() + `
+		WHERE completed_at IS NULL AND (` + s.optionalColumn("forced_at") + ` IS NULL OR ` + s.optionalColumn("forced_at") + ` <= started_at) 
 		ORDER BY id DESC 
 		LIMIT 1`
-	row := s.conn.QueryRow(qry)
+	row := s.db(ctx).QueryRowContext(ctx, qry)
 
 	latestFailedMigration := model.Migration{}
 	err := row.Scan(&latestFailedMigration.ID, &latestFailedMigration.Filename, &latestFailedMigration.StartedAt)
@@ -76,6 +340,76 @@ func (s *SQLStore) GetLatestFailedMigration() (*model.Migration, error) {
 }
 
 func (s *SQLStore) RawExec(rawSQL string) error {
-	_, err := s.conn.Exec(rawSQL)
+	return s.RawExecContext(context.Background(), rawSQL)
+}
+
+func (s *SQLStore) RawExecContext(ctx context.Context, rawSQL string) error {
+	_, err := s.db(ctx).ExecContext(ctx, rawSQL)
 	return err
 }
+
+// QueryTenantsContext runs a query that selects tenant names, e.g. the names of all tenant schemas, as its only column
+func (s *SQLStore) QueryTenantsContext(ctx context.Context, query string) ([]string, error) {
+	rows, err := s.db(ctx).QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var tenants []string
+	for rows.Next() {
+		var tenant string
+		if err := rows.Scan(&tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// column is a column of the migrations table that was added after the table was first released
+type column struct {
+	name       string
+	definition string
+}
+
+// addMissingColumns adds the given columns to migrations tables created by older versions
+func (s *SQLStore) addMissingColumns(ctx context.Context, columns ...column) error {
+	for _, col := range columns {
+		exists, err := s.columnExists(ctx, col.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := s.db(ctx).ExecContext(ctx, `ALTER TABLE `+s.quotedTable()+` ADD COLUMN `+col.name+` `+col.definition); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", col.name, err)
+		}
+	}
+	s.missingColumns = nil
+	return nil
+}
+
+// columnExists reports whether the migrations table has the given column
+func (s *SQLStore) columnExists(ctx context.Context, name string) (bool, error) {
+	var exists bool
+	err := s.db(ctx).QueryRowContext(ctx, s.dialect.rebind(s.dialect.columnExists), s.tableName, name, s.schema).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check whether column %s exists: %w", name, err)
+	}
+	return exists, nil
+}
+
+func (s *SQLStore) getMigration(ctx context.Context, id uint) (model.Migration, error) {
+	qry := `SELECT ` + s.migrationColumns() + ` FROM ` + s.quotedTable() + ` WHERE id = $1`
+	return scanMigration(s.db(ctx).QueryRowContext(ctx, s.dialect.rebind(qry), id))
+}
+
+// scanMigration scans a row selected with migrationColumns, which is either a *sql.Row or *sql.Rows
+func scanMigration(row interface{ Scan(dest ...any) error }) (model.Migration, error) {
+	result := model.Migration{}
+	err := row.Scan(&result.ID, &result.Filename, &result.StartedAt, &result.CompletedAt, &result.Checksum,
+		&result.ForcedBy, &result.ForcedAt)
+	return result, err
+}
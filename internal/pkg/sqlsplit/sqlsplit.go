@@ -0,0 +1,225 @@
+// Package sqlsplit splits Postgres scripts into single statements.
+package sqlsplit
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Statement is a single statement of a script along with its position in the script
+type Statement struct {
+	// SQL is the statement including leading comments, but without the terminating semicolon
+	SQL string
+	// Line and Column are the 1-based position of the statement's first character in the script
+	Line   int
+	Column int
+}
+
+// Split splits a script into statements at every semicolon that isn't part of a comment, a string literal, a quoted
+// identifier or a dollar-quoted string. Statements that consist of nothing but whitespace and comments are dropped.
+func Split(script string) []Statement {
+	var statements []Statement
+	l := lexer{script: script, line: 1, column: 1}
+
+	start, startLine, startColumn := -1, 0, 0
+	hasCode := false
+	for l.pos < len(script) {
+		if start < 0 && !isSpace(l.peek()) {
+			start, startLine, startColumn = l.pos, l.line, l.column
+		}
+
+		switch {
+		case strings.HasPrefix(script[l.pos:], "--"):
+			l.skipLineComment()
+			continue
+		case strings.HasPrefix(script[l.pos:], "/*"):
+			l.skipBlockComment()
+			continue
+		case l.peek() == ';':
+			if hasCode {
+				statements = append(statements, Statement{SQL: script[start:l.pos], Line: startLine, Column: startColumn})
+			}
+			l.advance(1)
+			start, hasCode = -1, false
+			continue
+		}
+
+		if !isSpace(l.peek()) {
+			hasCode = true
+		}
+		switch {
+		case l.peek() == '\'':
+			l.skipString(l.isEscapeString())
+		case l.peek() == '"':
+			l.skipQuoted('"')
+		case l.peek() == '$':
+			if tag, ok := l.dollarTag(); ok {
+				l.skipDollarQuoted(tag)
+			} else {
+				l.advance(1)
+			}
+		default:
+			l.advance(1)
+		}
+	}
+
+	if hasCode {
+		statements = append(statements, Statement{SQL: strings.TrimRightFunc(script[start:], unicode.IsSpace), Line: startLine, Column: startColumn})
+	}
+	return statements
+}
+
+// Position converts a 1-based character position within the statement, like the one reported by postgres, into the
+// 1-based line and column within the script
+func (s Statement) Position(position int) (line, column int) {
+	line, column = s.Line, s.Column
+	for _, r := range s.SQL {
+		if position--; position <= 0 {
+			break
+		}
+		if r == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
+
+type lexer struct {
+	script string
+	pos    int
+	line   int
+	column int
+}
+
+func (l *lexer) peek() byte {
+	return l.script[l.pos]
+}
+
+// advance moves n bytes forward, keeping track of the line and column
+func (l *lexer) advance(n int) {
+	end := l.pos + n
+	if end > len(l.script) {
+		end = len(l.script)
+	}
+	for l.pos < end {
+		r, size := utf8.DecodeRuneInString(l.script[l.pos:])
+		if r == '\n' {
+			l.line, l.column = l.line+1, 1
+		} else {
+			l.column++
+		}
+		l.pos += size
+	}
+}
+
+// advanceTo moves forward until after the next occurrence of token, or to the end of the script
+func (l *lexer) advanceTo(token string) {
+	if i := strings.Index(l.script[l.pos:], token); i >= 0 {
+		l.advance(i + len(token))
+		return
+	}
+	l.advance(len(l.script) - l.pos)
+}
+
+func (l *lexer) skipLineComment() {
+	l.advanceTo("\n")
+}
+
+// skipBlockComment skips a block comment, which can be nested in postgres
+func (l *lexer) skipBlockComment() {
+	depth := 0
+	for l.pos < len(l.script) {
+		switch {
+		case strings.HasPrefix(l.script[l.pos:], "/*"):
+			depth++
+			l.advance(2)
+		case strings.HasPrefix(l.script[l.pos:], "*/"):
+			depth--
+			l.advance(2)
+			if depth == 0 {
+				return
+			}
+		default:
+			l.advance(1)
+		}
+	}
+}
+
+// isEscapeString reports whether the string literal at the current position is an escape string, e.g. E'it\'s'
+func (l *lexer) isEscapeString() bool {
+	if l.pos == 0 || (l.script[l.pos-1] != 'E' && l.script[l.pos-1] != 'e') {
+		return false
+	}
+	return l.pos == 1 || !isIdentifierChar(l.script[l.pos-2])
+}
+
+// skipString skips a string literal, in which quotes are escaped by doubling them or, in escape strings, with a
+// backslash
+func (l *lexer) skipString(backslashEscapes bool) {
+	l.advance(1)
+	for l.pos < len(l.script) {
+		switch {
+		case backslashEscapes && l.peek() == '\\':
+			l.advance(2)
+		case strings.HasPrefix(l.script[l.pos:], "''"):
+			l.advance(2)
+		case l.peek() == '\'':
+			l.advance(1)
+			return
+		default:
+			l.advance(1)
+		}
+	}
+}
+
+// skipQuoted skips a quoted identifier, in which quotes are escaped by doubling them
+func (l *lexer) skipQuoted(quote byte) {
+	l.advance(1)
+	for l.pos < len(l.script) {
+		if l.peek() == quote {
+			l.advance(1)
+			if l.pos < len(l.script) && l.peek() == quote {
+				l.advance(1)
+				continue
+			}
+			return
+		}
+		l.advance(1)
+	}
+}
+
+// dollarTag returns the tag of the dollar quote at the current position, e.g. $body$ or $$. Positional parameters
+// like $1 and identifiers containing $ aren't dollar quotes.
+func (l *lexer) dollarTag() (string, bool) {
+	if l.pos > 0 && isIdentifierChar(l.script[l.pos-1]) {
+		return "", false
+	}
+	for i := l.pos + 1; i < len(l.script); i++ {
+		c := l.script[i]
+		switch {
+		case c == '$':
+			return l.script[l.pos : i+1], true
+		case c >= '0' && c <= '9' && i == l.pos+1:
+			return "", false
+		case !isIdentifierChar(c):
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func (l *lexer) skipDollarQuoted(tag string) {
+	l.advance(len(tag))
+	l.advanceTo(tag)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
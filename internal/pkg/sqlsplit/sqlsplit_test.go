@@ -0,0 +1,96 @@
+package sqlsplit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []Statement
+	}{
+		{
+			name:   "empty script",
+			script: " \n-- nothing to do here\n/* or here */;\n",
+			want:   nil,
+		},
+		{
+			name:   "single statement without semicolon",
+			script: "SELECT 1",
+			want:   []Statement{{SQL: "SELECT 1", Line: 1, Column: 1}},
+		},
+		{
+			name:   "multiple statements",
+			script: "CREATE TABLE a (id int);\n\n  INSERT INTO a VALUES (1);;\nSELECT 1;\n",
+			want: []Statement{
+				{SQL: "CREATE TABLE a (id int)", Line: 1, Column: 1},
+				{SQL: "INSERT INTO a VALUES (1)", Line: 3, Column: 3},
+				{SQL: "SELECT 1", Line: 4, Column: 1},
+			},
+		},
+		{
+			name:   "comments",
+			script: "-- first; statement\nSELECT 1; /* second; /* nested; */ statement */ SELECT 2 -- trailing;\n",
+			want: []Statement{
+				{SQL: "-- first; statement\nSELECT 1", Line: 1, Column: 1},
+				{SQL: "/* second; /* nested; */ statement */ SELECT 2 -- trailing;", Line: 2, Column: 11},
+			},
+		},
+		{
+			name:   "string literals and quoted identifiers",
+			script: `INSERT INTO "semi;colon" VALUES ('it''s; fine', E'it\'s; fine', e'\\');SELECT 2`,
+			want: []Statement{
+				{SQL: `INSERT INTO "semi;colon" VALUES ('it''s; fine', E'it\'s; fine', e'\\')`, Line: 1, Column: 1},
+				{SQL: "SELECT 2", Line: 1, Column: 72},
+			},
+		},
+		{
+			name:   "backslash in standard string",
+			script: `SELECT 'C:\';SELECT 2`,
+			want: []Statement{
+				{SQL: `SELECT 'C:\'`, Line: 1, Column: 1},
+				{SQL: "SELECT 2", Line: 1, Column: 14},
+			},
+		},
+		{
+			name: "dollar quoting",
+			script: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;\n" +
+				"DO $body$ BEGIN RAISE NOTICE '$$;'; END $body$;\n" +
+				"PREPARE p AS SELECT $1;",
+			want: []Statement{
+				{SQL: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", Line: 1, Column: 1},
+				{SQL: "DO $body$ BEGIN RAISE NOTICE '$$;'; END $body$", Line: 2, Column: 1},
+				{SQL: "PREPARE p AS SELECT $1", Line: 3, Column: 1},
+			},
+		},
+		{
+			name:   "unterminated string",
+			script: "SELECT 1; SELECT 'oops; SELECT 3",
+			want: []Statement{
+				{SQL: "SELECT 1", Line: 1, Column: 1},
+				{SQL: "SELECT 'oops; SELECT 3", Line: 1, Column: 11},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, Split(tt.script))
+		})
+	}
+}
+
+func TestStatement_Position(t *testing.T) {
+	statement := Statement{SQL: "SELECT 'ä',\n  nope", Line: 3, Column: 5}
+
+	line, column := statement.Position(1)
+	require.Equal(t, [2]int{3, 5}, [2]int{line, column})
+
+	line, column = statement.Position(9) // the 'ä' counts as a single character
+	require.Equal(t, [2]int{3, 13}, [2]int{line, column})
+
+	line, column = statement.Position(15)
+	require.Equal(t, [2]int{4, 3}, [2]int{line, column})
+}
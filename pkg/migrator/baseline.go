@@ -0,0 +1,71 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// Baseline records every migration file up to and including the target as applied, without executing it. This is
+// meant for adopting litemigrate on a database whose schema already exists: Up() then continues after the target. The
+// target is either a filename or a numeric version prefix (e.g. "3" for 003_foo.sql). It returns the filenames that
+// were recorded, files that have already been applied are skipped.
+func (s *Service) Baseline(target string) ([]string, error) {
+	return s.BaselineContext(context.Background(), target)
+}
+
+// BaselineContext is like Baseline, but stops once ctx is done
+func (s *Service) BaselineContext(ctx context.Context, target string) (baselined []string, err error) {
+	if target == "" {
+		return nil, fmt.Errorf("%w: empty target", ErrTargetNotFound)
+	}
+
+	err = s.withLock(ctx, func() error {
+		baselined, err = s.baseline(ctx, target)
+		return err
+	})
+	return baselined, err
+}
+
+func (s *Service) baseline(ctx context.Context, target string) ([]string, error) {
+	plan, err := s.planUpTo(ctx, target, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// all or nothing, so that a failure doesn't leave a partial baseline behind
+	baselined := make([]string, 0, len(plan.Migrations))
+	err = s.store.ExecTxContext(ctx, func(ctx context.Context, _ *sql.Tx) error {
+		for _, planned := range plan.Migrations {
+			// a migration awaiting a retry already has its row
+			if planned.previous != nil {
+				if err := s.store.UpdateChecksumContext(ctx, planned.previous.ID, planned.checksum()); err != nil {
+					return fmt.Errorf("failed to update migrations table: %w", err)
+				}
+				if _, err := s.store.MarkMigrationCompletedContext(ctx, planned.previous.ID); err != nil {
+					return fmt.Errorf("failed to update migrations table: %w", err)
+				}
+				baselined = append(baselined, planned.Filename)
+				continue
+			}
+			migration, err := s.store.InsertMigrationContext(ctx, planned.Filename, planned.checksum())
+			if err != nil {
+				return fmt.Errorf("failed to insert migration %s into migrations table: %w", planned.Filename, err)
+			}
+			if _, err := s.store.MarkMigrationCompletedContext(ctx, migration.ID); err != nil {
+				return fmt.Errorf("failed to update migrations table: %w", err)
+			}
+			baselined = append(baselined, planned.Filename)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("baselined migrations without running them", zap.Strings("filenames", baselined),
+		zap.Int("already_applied", plan.Applied))
+	return baselined, nil
+}
@@ -0,0 +1,48 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// callbacks maps the callback files found in the migrations directory, e.g. beforeAll.sql, to their rendered SQL.
+// Callbacks are run around migrations, but aren't recorded in the migrations table. beforeAll and afterAll run outside
+// of any transaction, on the same connection as the migrations, so session settings they make apply to the whole run.
+type callbacks map[string]string
+
+// loadCallbacks reads and renders the callback files in the migrations directory
+func (s *Service) loadCallbacks() (callbacks, error) {
+	files, err := s.fsUtils.GetCallbackFileList(s.migrationPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list callback files: %w", err)
+	}
+
+	result := callbacks{}
+	for _, file := range files {
+		rawSQL, err := s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read callback file %s: %w", file.Name(), err)
+		}
+		if result[file.Name()], err = s.render(file.Name(), rawSQL); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// runCallback executes the callback file with the given name, if it exists
+func (s *Service) runCallback(ctx context.Context, cbs callbacks, name string) error {
+	rawSQL, ok := cbs[name]
+	if !ok {
+		return nil
+	}
+
+	s.logger.Debug("running callback", zap.String("filename", name))
+	if err := s.execSQL(ctx, name, rawSQL); err != nil {
+		return fmt.Errorf("callback %s failed: %w", name, err)
+	}
+	return nil
+}
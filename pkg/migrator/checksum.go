@@ -0,0 +1,142 @@
+package migrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/ymakhloufi/litemigrate/internal/pkg/fsutils"
+	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
+	"go.uber.org/zap"
+)
+
+var ErrChecksumMismatch = fmt.Errorf("migration file modified after it was applied")
+
+// checksum returns the hex-encoded SHA-256 checksum of a migration file's content
+func checksum(rawSQL string) string {
+	sum := sha256.Sum256([]byte(rawSQL))
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumDrift is an applied migration along with the current checksum of its file
+type checksumDrift struct {
+	migration model.Migration
+	checksum  string
+}
+
+func (d checksumDrift) err() error {
+	return fmt.Errorf("%w: %s (applied with checksum %s, file now has checksum %s)",
+		ErrChecksumMismatch, d.migration.Filename, d.migration.Checksum, d.checksum)
+}
+
+// compareChecksums compares the recorded checksums of all completed migrations with their files on disk. It returns
+// the migrations whose files have been modified since, and those that were applied before checksums were recorded.
+// Orphaned migrations whose files don't exist anymore, Go migrations and repeatable migrations are skipped.
+func (s *Service) compareChecksums(migrations []model.Migration) (modified, unrecorded []checksumDrift, err error) {
+	for _, migration := range migrations {
+		if migration.CompletedAt == nil || s.goMigrations[migration.Filename] != nil || fsutils.IsRepeatable(migration.Filename) {
+			continue
+		}
+
+		rawSQL, err := s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, migration.Filename))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to read migration file %s: %w", migration.Filename, err)
+		}
+
+		current := checksum(rawSQL)
+		switch migration.Checksum {
+		case current:
+		case "":
+			unrecorded = append(unrecorded, checksumDrift{migration: migration, checksum: current})
+		default:
+			modified = append(modified, checksumDrift{migration: migration, checksum: current})
+		}
+	}
+
+	return modified, unrecorded, nil
+}
+
+// ensureNoChecksumDrift fails if any applied migration file has been modified. If recordMissing is true, migrations
+// applied before checksums were recorded get their current checksum recorded.
+func (s *Service) ensureNoChecksumDrift(ctx context.Context, recordMissing bool) error {
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	modified, unrecorded, err := s.compareChecksums(migrations)
+	if err != nil {
+		return err
+	}
+
+	problems := make([]error, 0, len(modified))
+	for _, drift := range modified {
+		problems = append(problems, drift.err())
+	}
+	if len(problems) > 0 {
+		return errors.Join(problems...)
+	}
+	if !recordMissing {
+		return nil
+	}
+
+	for _, drift := range unrecorded {
+		s.logger.Info("recording checksum of migration applied without one", zap.String("filename", drift.migration.Filename))
+		if err := s.store.UpdateChecksumContext(ctx, drift.migration.ID, drift.checksum); err != nil {
+			return fmt.Errorf("failed to record checksum of migration %s: %w", drift.migration.Filename, err)
+		}
+	}
+
+	return nil
+}
+
+// AcceptChecksum re-accepts the modified file of an applied migration by recording its current checksum. This is the
+// explicit override for ErrChecksumMismatch, e.g. after a comment in an applied migration was fixed. The migration is
+// NOT run again.
+func (s *Service) AcceptChecksum(filename string) error {
+	return s.AcceptChecksumContext(context.Background(), filename)
+}
+
+// AcceptChecksumContext is like AcceptChecksum, but stops once ctx is done
+func (s *Service) AcceptChecksumContext(ctx context.Context, filename string) error {
+	return s.withLock(ctx, func() error {
+		return s.acceptChecksum(ctx, filename)
+	})
+}
+
+func (s *Service) acceptChecksum(ctx context.Context, filename string) error {
+	if err := s.store.EnsureMigrationTableExistsContext(ctx); err != nil {
+		return fmt.Errorf("failed to ensure migrations table exists: %w", err)
+	}
+
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	for _, migration := range migrations {
+		if migration.Filename != filename {
+			continue
+		}
+
+		rawSQL, err := s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, filename))
+		if err != nil {
+			return fmt.Errorf("failed to read migration file %s: %w", filename, err)
+		}
+		current := checksum(rawSQL)
+		if err := s.store.UpdateChecksumContext(ctx, migration.ID, current); err != nil {
+			return fmt.Errorf("failed to update checksum of migration %s: %w", filename, err)
+		}
+
+		s.logger.Warn("accepted new checksum of applied migration", zap.String("filename", filename),
+			zap.String("old_checksum", migration.Checksum), zap.String("new_checksum", current))
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrMigrationNotFound, filename)
+}
@@ -0,0 +1,130 @@
+package migrator
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ymakhloufi/litemigrate/internal/pkg/fsutils"
+)
+
+const defaultSequenceWidth = 3
+
+// timestampFormat is the version prefix of files created with NumberingTimestamp, e.g. 20240131154500
+const timestampFormat = "20060102150405"
+
+// Numbering decides how Create picks the version prefix of new migration files
+type Numbering string
+
+const (
+	// NumberingSequence uses the next free sequence number, padded like the existing files, e.g. 004_add_users.up.sql
+	NumberingSequence Numbering = "sequence"
+	// NumberingTimestamp uses the current UTC time, e.g. 20240131154500_add_users.up.sql, which avoids collisions
+	// between branches that add migrations at the same time
+	NumberingTimestamp Numbering = "timestamp"
+)
+
+var (
+	ErrInvalidMigrationName = fmt.Errorf("invalid migration name")
+	ErrInvalidNumbering     = fmt.Errorf("invalid numbering")
+	ErrInvalidTemplate      = fmt.Errorf("invalid migration template")
+
+	nonWordCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// TemplateData is passed to the template set with WithTemplate when rendering a new migration file
+type TemplateData struct {
+	// Name is the sanitized name of the migration, e.g. add_users
+	Name string
+	// Version is the version prefix of the migration, e.g. 004
+	Version string
+	// Direction is either "up" or "down"
+	Direction string
+}
+
+// WithNumbering sets how Create picks the version prefix of new migration files, NumberingSequence by default
+func WithNumbering(numbering Numbering) Option {
+	return func(s *Service) {
+		s.numbering = numbering
+	}
+}
+
+// WithTemplate makes Create fill new migration files by executing the text/template tmpl with TemplateData, instead
+// of leaving them empty
+func WithTemplate(tmpl string) Option {
+	return func(s *Service) {
+		s.template = tmpl
+	}
+}
+
+// Create writes a pair of up/down migration files named after the next version, e.g. 004_add_users.up.sql and
+// 004_add_users.down.sql, see WithNumbering and WithTemplate. It returns the paths of the created files.
+func (s *Service) Create(name string) ([]string, error) {
+	name = strings.Trim(nonWordCharacters.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return nil, ErrInvalidMigrationName
+	}
+
+	tmpl, err := template.New("migration").Option("missingkey=error").Parse(s.template)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTemplate, err)
+	}
+
+	version, err := s.nextVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	base := version + "_" + name
+	paths := make([]string, 0, 2)
+	for _, direction := range []string{"up", "down"} {
+		var content strings.Builder
+		if err := tmpl.Execute(&content, TemplateData{Name: name, Version: version, Direction: direction}); err != nil {
+			return paths, fmt.Errorf("%w: %s", ErrInvalidTemplate, err)
+		}
+
+		path := filepath.Join(s.migrationPath, base+"."+direction+".sql")
+		if err := s.fsUtils.CreateFile(path, content.String()); err != nil {
+			return paths, fmt.Errorf("failed to create migration file %s: %w", path, err)
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// nextVersion returns the version prefix for a new migration file, which always sorts after the existing ones
+func (s *Service) nextVersion() (string, error) {
+	files, err := s.migrationFiles()
+	if err != nil {
+		return "", fmt.Errorf("failed to get migration file list in dir %s: %w", s.migrationPath, err)
+	}
+
+	next, width := uint64(1), defaultSequenceWidth
+	for _, file := range files {
+		seq, prefix, ok := fsutils.Version(file.Name())
+		if !ok {
+			continue
+		}
+		if seq >= next {
+			next, width = seq+1, len(prefix)
+		}
+	}
+
+	switch s.numbering {
+	case "", NumberingSequence:
+		return fmt.Sprintf("%0*d", width, next), nil
+	case NumberingTimestamp:
+		timestamp := s.now().UTC().Format(timestampFormat)
+		// two migrations created within the same second still get distinct, ordered versions
+		if seq, _ := strconv.ParseUint(timestamp, 10, 64); seq < next {
+			return strconv.FormatUint(next, 10), nil
+		}
+		return timestamp, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrInvalidNumbering, s.numbering)
+	}
+}
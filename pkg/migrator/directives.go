@@ -0,0 +1,52 @@
+package migrator
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const directivePrefix = "-- litemigrate:"
+
+// directiveNoTransaction makes a migration run outside a transaction, which is needed for statements like
+// CREATE INDEX CONCURRENTLY that Postgres refuses to run inside one
+const directiveNoTransaction = "no-transaction"
+
+// transactionStart matches statements that begin a transaction, e.g. "BEGIN;" or "START TRANSACTION;"
+var transactionStart = regexp.MustCompile(`(?i)^(BEGIN|START\s+TRANSACTION)\b`)
+
+// hasDirective reports whether the migration's header, i.e. the comments and blank lines before its first statement,
+// contains the given directive, e.g. "-- litemigrate:no-transaction"
+func hasDirective(rawSQL, directive string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(rawSQL))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			return false
+		}
+		if strings.EqualFold(line, directivePrefix+directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// beginsTransaction reports whether the migration's first statement, after any comments, begins a transaction of its
+// own
+func beginsTransaction(rawSQL string) bool {
+	for {
+		rawSQL = strings.TrimLeftFunc(rawSQL, unicode.IsSpace)
+		switch {
+		case strings.HasPrefix(rawSQL, "--"):
+			_, rawSQL, _ = strings.Cut(rawSQL, "\n")
+		case strings.HasPrefix(rawSQL, "/*"):
+			_, rawSQL, _ = strings.Cut(rawSQL, "*/")
+		default:
+			return transactionStart.MatchString(rawSQL)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
+	"go.uber.org/zap"
+)
+
+// ForceMode decides how Force resolves a dirty migration
+type ForceMode string
+
+const (
+	// ForceCompleted marks the dirty migration as completed, so that future runs continue after it
+	ForceCompleted ForceMode = "completed"
+	// ForceRetry makes the next run execute the dirty migration again, see model.Migration.AwaitsRetry
+	ForceRetry ForceMode = "retry"
+)
+
+var ErrInvalidForceMode = fmt.Errorf("invalid force mode")
+
+// Force resolves the dirty migration with the given filename according to mode. forcedBy names whoever forces the
+// migration, e.g. user@host. It is recorded in the migrations table along with the time, and kept once a retried
+// migration completes. Only use this once you made sure that the failed migration didn't leave the database in a
+// broken state.
+func (s *Service) Force(filename string, mode ForceMode, forcedBy string) (model.Migration, error) {
+	return s.ForceContext(context.Background(), filename, mode, forcedBy)
+}
+
+// ForceContext is like Force, but stops once ctx is done
+func (s *Service) ForceContext(ctx context.Context, filename string, mode ForceMode, forcedBy string) (migration model.Migration, err error) {
+	if mode != ForceCompleted && mode != ForceRetry {
+		return model.Migration{}, fmt.Errorf("%w: %s", ErrInvalidForceMode, mode)
+	}
+
+	err = s.withLock(ctx, func() error {
+		migration, err = s.force(ctx, filename, mode, forcedBy)
+		return err
+	})
+	return migration, err
+}
+
+func (s *Service) force(ctx context.Context, filename string, mode ForceMode, forcedBy string) (model.Migration, error) {
+	if err := s.store.EnsureMigrationTableExistsContext(ctx); err != nil {
+		return model.Migration{}, fmt.Errorf("failed to ensure migrations table exists: %w", err)
+	}
+
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return model.Migration{}, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	for _, migration := range migrations {
+		if migration.Filename != filename {
+			continue
+		}
+		if migration.CompletedAt != nil {
+			return model.Migration{}, fmt.Errorf("%w: %s", ErrMigrationNotDirty, filename)
+		}
+
+		if mode == ForceRetry {
+			migration, err = s.store.MarkMigrationForRetryContext(ctx, migration.ID, forcedBy)
+			if err != nil {
+				return model.Migration{}, fmt.Errorf("failed to update migrations table: %w", err)
+			}
+			s.logger.Warn("dirty migration has been forced to run again", zap.Any("migration", migration))
+			return migration, nil
+		}
+
+		migration, err = s.store.MarkMigrationForcedContext(ctx, migration.ID, forcedBy)
+		if err != nil {
+			return model.Migration{}, fmt.Errorf("failed to update migrations table: %w", err)
+		}
+		s.logger.Warn("dirty migration has been forced to completed", zap.Any("migration", migration))
+		return migration, nil
+	}
+
+	return model.Migration{}, fmt.Errorf("%w: %s", ErrMigrationNotFound, filename)
+}
@@ -0,0 +1,88 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ymakhloufi/litemigrate/internal/pkg/fsutils"
+)
+
+// GoMigrationFunc is a migration written in Go. It runs inside the transaction that also records it in the
+// migrations table, so if it returns an error, everything it did through tx is rolled back.
+type GoMigrationFunc func(ctx context.Context, tx *sql.Tx) error
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]GoMigrationFunc{}
+)
+
+// Register makes a Go migration available to all services created by New afterwards, usually from an init function.
+// The name must start with a version like a migration file, e.g. "005_backfill", so that the migration runs in order
+// with the SQL files. It is recorded in the migrations table under that name. Register panics if the name has no
+// version or is registered twice.
+func Register(name string, fn GoMigrationFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, _, ok := fsutils.Version(name); !ok {
+		panic(fmt.Sprintf("migrator: Go migration %q doesn't start with a version", name))
+	}
+	if fn == nil {
+		panic(fmt.Sprintf("migrator: Go migration %q is nil", name))
+	}
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("migrator: Go migration %q registered twice", name))
+	}
+	registry[name] = fn
+}
+
+// registered returns a copy of all Go migrations registered so far
+func registered() map[string]GoMigrationFunc {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	result := make(map[string]GoMigrationFunc, len(registry))
+	for name, fn := range registry {
+		result[name] = fn
+	}
+	return result
+}
+
+// goMigrationEntry lets a Go migration be sorted along with the migration files
+type goMigrationEntry string
+
+func (e goMigrationEntry) Name() string               { return string(e) }
+func (e goMigrationEntry) IsDir() bool                { return false }
+func (e goMigrationEntry) Type() fs.FileMode          { return 0 }
+func (e goMigrationEntry) Info() (fs.FileInfo, error) { return nil, fs.ErrNotExist }
+
+// migrationFiles lists the migration files along with the registered Go migrations, in version order
+func (s *Service) migrationFiles() (fsutils.DirElements, error) {
+	files, err := s.fsUtils.GetMigrationFileList(s.migrationPath)
+	if err != nil || len(s.goMigrations) == 0 {
+		return files, err
+	}
+
+	versions := make(map[uint64]string, len(files))
+	for _, file := range files {
+		if version, _, ok := fsutils.Version(file.Name()); ok && !strings.HasSuffix(strings.ToLower(file.Name()), "down.sql") {
+			versions[version] = file.Name()
+		}
+	}
+	for name := range s.goMigrations {
+		version, _, _ := fsutils.Version(name)
+		if other, exists := versions[version]; exists {
+			return nil, fmt.Errorf("%w: %s and Go migration %s", ErrDuplicateVersion, other, name)
+		}
+		versions[version] = name
+		files = append(files, goMigrationEntry(name))
+	}
+
+	sort.Sort(files)
+	return files, nil
+}
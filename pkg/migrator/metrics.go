@@ -0,0 +1,123 @@
+package migrator
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ymakhloufi/litemigrate/internal/pkg/fsutils"
+	"go.uber.org/zap"
+)
+
+const metricsNamespace = "litemigrate"
+
+// Metrics are the Prometheus metrics of Up() and UpTo(), see WithMetrics
+type Metrics struct {
+	applied  prometheus.Counter
+	skipped  prometheus.Counter
+	failed   prometheus.Counter
+	duration prometheus.Histogram
+	dirty    prometheus.Gauge
+	version  prometheus.Gauge
+}
+
+// NewMetrics creates the metrics and registers them with registerer. It fails if they are already registered.
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		applied: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "migrations_applied_total",
+			Help:      "Number of migrations that have run successfully.",
+		}),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "migrations_skipped_total",
+			Help:      "Number of migrations that were skipped because they had already been applied.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "migrations_failed_total",
+			Help:      "Number of migrations that have failed.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "migration_duration_seconds",
+			Help:      "Duration of running a single migration, successful or not.",
+			Buckets:   []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		}),
+		dirty: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "dirty",
+			Help:      "1 if a migration has been started but never completed, 0 otherwise.",
+		}),
+		version: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "schema_version",
+			Help:      "Version of the most recently applied versioned migration, 0 if none has been applied.",
+		}),
+	}
+
+	for _, collector := range []prometheus.Collector{m.applied, m.skipped, m.failed, m.duration, m.dirty, m.version} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// WithMetrics makes Up() and UpTo() record their runs in m. The dirty flag and the schema version are read from the
+// migrations table once the run is over, whether it succeeded or not.
+func WithMetrics(m *Metrics) Option {
+	return func(s *Service) {
+		s.metrics = m
+	}
+}
+
+// observeMigration records the outcome of running a single migration that started at start
+func (s *Service) observeMigration(start time.Time, err error) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.duration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.metrics.failed.Inc()
+		return
+	}
+	s.metrics.applied.Inc()
+}
+
+// observeSkipped records the migrations that have been skipped because they had already been applied
+func (s *Service) observeSkipped(n int) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.skipped.Add(float64(n))
+}
+
+// observeState records the dirty flag and the schema version as they are in the migrations table. Failing to read it
+// is only logged, so it doesn't hide the outcome of the run.
+func (s *Service) observeState(ctx context.Context) {
+	if s.metrics == nil {
+		return
+	}
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		s.logger.Warn("failed to read migrations table for metrics", zap.Error(err))
+		return
+	}
+
+	dirty, version := 0.0, uint64(0)
+	for _, migration := range migrations {
+		if migration.IsDirty() {
+			dirty = 1
+		}
+		if migration.CompletedAt == nil {
+			continue
+		}
+		if v, _, ok := fsutils.Version(migration.Filename); ok && v > version {
+			version = v
+		}
+	}
+	s.metrics.dirty.Set(dirty)
+	s.metrics.version.Set(float64(version))
+}
@@ -0,0 +1,214 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/ymakhloufi/litemigrate/internal/pkg/fsutils"
+	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
+	"go.uber.org/zap"
+)
+
+type PlannedMigration struct {
+	Filename string
+	// SQL is the content of the migration file as it is executed, i.e. rendered with the template variables. It is
+	// empty for Go migrations.
+	SQL string
+
+	// source is the content of the migration file before rendering
+	source string
+	fn     GoMigrationFunc
+	// previous is the last run of a repeatable migration that is run again because its content has changed, or of a
+	// migration that has been forced to run again
+	previous *model.Migration
+}
+
+// IsRepeatable reports whether the migration is a repeatable migration, e.g. R__views.sql
+func (m PlannedMigration) IsRepeatable() bool {
+	return fsutils.IsRepeatable(m.Filename)
+}
+
+// IsGo reports whether the migration is a Go migration, see Register
+func (m PlannedMigration) IsGo() bool {
+	return m.fn != nil
+}
+
+// checksum returns the checksum recorded for the migration, Go migrations have none
+func (m PlannedMigration) checksum() string {
+	if m.fn != nil {
+		return ""
+	}
+	if m.source != "" {
+		return checksum(m.source)
+	}
+	return checksum(m.SQL)
+}
+
+// Plan lists the migrations that Up() would run, in order
+type Plan struct {
+	Migrations []PlannedMigration
+	// Repeatable are the repeatable migrations that are new or have changed, which run after Migrations
+	Repeatable []PlannedMigration
+	// Applied is the number of migration files that are skipped because they have already been applied
+	Applied int
+}
+
+// Print writes every pending migration with its full SQL to w, followed by a summary
+func (p Plan) Print(w io.Writer) error {
+	for _, migration := range p.all() {
+		content := migration.SQL
+		if migration.IsGo() {
+			content = "-- (Go migration)"
+		}
+		if _, err := fmt.Fprintf(w, "-- %s\n%s\n\n", migration.Filename, content); err != nil {
+			return err
+		}
+	}
+
+	if len(p.Repeatable) > 0 {
+		_, err := fmt.Fprintf(w, "-- %d pending migration(s), %d repeatable migration(s) to run, %d already applied\n",
+			len(p.Migrations), len(p.Repeatable), p.Applied)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "-- %d pending migration(s), %d already applied\n", len(p.Migrations), p.Applied)
+	return err
+}
+
+// all returns the migrations in the order they run, i.e. repeatable migrations last
+func (p Plan) all() []PlannedMigration {
+	return append(p.Migrations[:len(p.Migrations):len(p.Migrations)], p.Repeatable...)
+}
+
+// ErrOutOfOrderMigration means a pending migration file sorts before migrations that have already been applied, e.g.
+// because a feature branch was merged late. See WithAllowOutOfOrder.
+var ErrOutOfOrderMigration = fmt.Errorf("out-of-order migration")
+
+// WithAllowOutOfOrder makes Up() apply pending migrations that sort before already applied ones, logging a warning,
+// instead of failing with ErrOutOfOrderMigration
+func WithAllowOutOfOrder() Option {
+	return func(s *Service) {
+		s.allowOutOfOrder = true
+	}
+}
+
+// Plan returns the pending migrations that Up() would run, without running them or changing anything in the database
+func (s *Service) Plan() (Plan, error) {
+	return s.PlanContext(context.Background())
+}
+
+// PlanContext is like Plan, but stops once ctx is done
+func (s *Service) PlanContext(ctx context.Context) (Plan, error) {
+	return s.planReadOnly(ctx, "")
+}
+
+// PlanUpTo returns the pending migrations that UpTo(target) would run, without running them
+func (s *Service) PlanUpTo(target string) (Plan, error) {
+	return s.PlanUpToContext(context.Background(), target)
+}
+
+// PlanUpToContext is like PlanUpTo, but stops once ctx is done
+func (s *Service) PlanUpToContext(ctx context.Context, target string) (Plan, error) {
+	if target == "" {
+		return Plan{}, fmt.Errorf("%w: empty target", ErrTargetNotFound)
+	}
+	return s.planReadOnly(ctx, target)
+}
+
+// planReadOnly plans the pending migrations up to the target without changing anything in the database, see readOnly
+func (s *Service) planReadOnly(ctx context.Context, target string) (Plan, error) {
+	ro, err := s.readOnly(ctx)
+	if err != nil {
+		return Plan{}, err
+	}
+	return ro.planUpTo(ctx, target, false)
+}
+
+// planUpTo makes sure the database is in a state to run migrations and plans them. If recordChecksums is true,
+// missing checksums of migrations applied before checksums were recorded are filled in.
+func (s *Service) planUpTo(ctx context.Context, target string, recordChecksums bool) (Plan, error) {
+	if err := s.store.EnsureMigrationTableExistsContext(ctx); err != nil {
+		return Plan{}, fmt.Errorf("failed to ensure migrations table exists: %w", err)
+	}
+	if migration, err := s.ensureNoDirtyMigrationsExist(ctx); err != nil {
+		return Plan{}, fmt.Errorf("dirty migration %s found: %w", migration.Filename, err)
+	}
+	if err := s.ensureNoChecksumDrift(ctx, recordChecksums); err != nil {
+		return Plan{}, err
+	}
+	return s.plan(ctx, target)
+}
+
+// plan reads all pending migration files up to and including the target, or all of them if the target is empty
+func (s *Service) plan(ctx context.Context, target string) (Plan, error) {
+	files, err := s.migrationFiles()
+	if err != nil {
+		return Plan{}, fmt.Errorf("failed to get migration file list in dir %s: %w", s.migrationPath, err)
+	}
+	if target != "" {
+		if files, err = truncateAtTarget(files, target); err != nil {
+			return Plan{}, err
+		}
+	}
+
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return Plan{}, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	applied := make(map[string]model.Migration, len(migrations))
+	for _, migration := range migrations {
+		applied[migration.Filename] = migration
+	}
+
+	plan := Plan{}
+	var outOfOrder []string
+	for _, file := range files {
+		previous, wasRun := applied[file.Name()]
+		isRetry := wasRun && previous.AwaitsRetry()
+		if isRetry {
+			s.logger.Info("migration has been forced to run again", zap.String("filename", file.Name()),
+				zap.String("forced_by", previous.ForcedBy))
+		} else if wasRun {
+			s.logger.Info("Skipped: skipping migration, already run", zap.String("filename", file.Name()))
+			plan.Applied++
+			// everything pending so far sorts before an applied migration
+			for _, pending := range plan.Migrations[len(outOfOrder):] {
+				outOfOrder = append(outOfOrder, pending.Filename)
+			}
+			continue
+		}
+
+		planned := PlannedMigration{Filename: file.Name(), fn: s.goMigrations[file.Name()]}
+		if isRetry {
+			planned.previous = &previous
+		}
+		if planned.fn == nil {
+			if planned.source, err = s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, file.Name())); err != nil {
+				return Plan{}, fmt.Errorf("failed to read migration file %s: %w", file.Name(), err)
+			}
+			if planned.SQL, err = s.render(file.Name(), planned.source); err != nil {
+				return Plan{}, err
+			}
+		}
+		plan.Migrations = append(plan.Migrations, planned)
+	}
+
+	if len(outOfOrder) > 0 {
+		if !s.allowOutOfOrder {
+			return Plan{}, fmt.Errorf("%w: %s sort(s) before migrations that have already been applied",
+				ErrOutOfOrderMigration, strings.Join(outOfOrder, ", "))
+		}
+		s.logger.Warn("applying migrations out of order", zap.Strings("filenames", outOfOrder))
+	}
+
+	// repeatable migrations may depend on migrations after the target, so they only run without one
+	if target != "" {
+		return plan, nil
+	}
+	if plan.Repeatable, err = s.planRepeatables(applied); err != nil {
+		return Plan{}, err
+	}
+	return plan, nil
+}
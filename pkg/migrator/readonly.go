@@ -0,0 +1,51 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
+)
+
+// readOnlyStore is the store as seen by Plan(), dry runs, Status() and Validate(). They must not change the database, so the
+// migrations table isn't created. If it doesn't exist yet, no migration has been applied.
+type readOnlyStore struct {
+	Store
+	tableExists bool
+}
+
+func (s readOnlyStore) EnsureMigrationTableExistsContext(_ context.Context) error {
+	return nil
+}
+
+func (s readOnlyStore) HasMigrationRunContext(ctx context.Context, filename string) (bool, error) {
+	if !s.tableExists {
+		return false, nil
+	}
+	return s.Store.HasMigrationRunContext(ctx, filename)
+}
+
+func (s readOnlyStore) GetLatestFailedMigrationContext(ctx context.Context) (*model.Migration, error) {
+	if !s.tableExists {
+		return nil, nil
+	}
+	return s.Store.GetLatestFailedMigrationContext(ctx)
+}
+
+func (s readOnlyStore) GetMigrationsContext(ctx context.Context) ([]model.Migration, error) {
+	if !s.tableExists {
+		return nil, nil
+	}
+	return s.Store.GetMigrationsContext(ctx)
+}
+
+// readOnly returns a copy of the service that reads the migrations table, but neither creates nor upgrades it
+func (s *Service) readOnly(ctx context.Context) (*Service, error) {
+	exists, err := s.store.MigrationTableExistsContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check whether migrations table exists: %w", err)
+	}
+	ro := *s
+	ro.store = readOnlyStore{Store: s.store, tableExists: exists}
+	return &ro, nil
+}
@@ -0,0 +1,50 @@
+package migrator
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ymakhloufi/litemigrate/internal/pkg/fsutils"
+	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
+)
+
+// planRepeatables reads the repeatable migration files, e.g. R__views.sql, that have never been run or whose content
+// has changed since they were last run, going by the applied migrations by filename
+func (s *Service) planRepeatables(applied map[string]model.Migration) ([]PlannedMigration, error) {
+	files, err := s.fsUtils.GetRepeatableFileList(s.migrationPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repeatable migration file list in dir %s: %w", s.migrationPath, err)
+	}
+
+	var result []PlannedMigration
+	for _, file := range files {
+		rawSQL, err := s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration file %s: %w", file.Name(), err)
+		}
+		planned := PlannedMigration{Filename: file.Name(), source: rawSQL}
+		if previous, ok := applied[file.Name()]; ok {
+			if previous.Checksum == planned.checksum() && !previous.AwaitsRetry() {
+				continue
+			}
+			planned.previous = &previous
+		}
+		if planned.SQL, err = s.render(file.Name(), rawSQL); err != nil {
+			return nil, err
+		}
+		result = append(result, planned)
+	}
+	return result, nil
+}
+
+// rollbackable leaves out repeatable migrations, which can't be rolled back, and migrations awaiting a retry, which
+// haven't been completed
+func rollbackable(migrations []model.Migration) []model.Migration {
+	result := make([]model.Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		if !fsutils.IsRepeatable(migration.Filename) && !migration.AwaitsRetry() {
+			result = append(result, migration)
+		}
+	}
+	return result
+}
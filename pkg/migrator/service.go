@@ -1,120 +1,607 @@
 package migrator
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ymakhloufi/litemigrate/internal/pkg/fsutils"
 	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
 	"go.uber.org/zap"
 )
 
-var ErrDirtyMigrationExists = fmt.Errorf("dirty migration")
+var (
+	ErrDirtyMigrationExists  = fmt.Errorf("dirty migration")
+	ErrDownMigrationNotFound = fmt.Errorf("down migration file not found")
+	ErrInvalidSteps          = fmt.Errorf("number of steps must be positive")
+	ErrNoMigrationsApplied   = fmt.Errorf("no migrations applied")
+	ErrMigrationNotFound     = fmt.Errorf("migration not found")
+	ErrMigrationNotDirty     = fmt.Errorf("migration is not dirty")
+	ErrMissingMigrationFile  = fmt.Errorf("migration file missing")
+	ErrTargetNotFound        = fmt.Errorf("target migration not found")
+)
 
+// Store keeps track of the applied migrations and executes them. All methods that talk to the database take a
+// context, which stops them once it is done.
 type Store interface {
-	HasMigrationRun(filename string) (bool, error)
-	InsertMigration(filename string) (model.Migration, error)
-	RawExec(s string) error
-	MarkMigrationCompleted(id uint) (model.Migration, error)
-	EnsureMigrationTableExists() error
-	GetLatestFailedMigration() (*model.Migration, error)
+	HasMigrationRunContext(ctx context.Context, filename string) (bool, error)
+	InsertMigrationContext(ctx context.Context, filename, checksum string) (model.Migration, error)
+	RawExecContext(ctx context.Context, s string) error
+	MarkMigrationCompletedContext(ctx context.Context, id uint) (model.Migration, error)
+	MarkMigrationForcedContext(ctx context.Context, id uint, forcedBy string) (model.Migration, error)
+	MarkMigrationForRetryContext(ctx context.Context, id uint, forcedBy string) (model.Migration, error)
+	// RestartMigrationContext marks a migration that is run again as started now and not completed
+	RestartMigrationContext(ctx context.Context, id uint) error
+	UpdateChecksumContext(ctx context.Context, id uint, checksum string) error
+	EnsureMigrationTableExistsContext(ctx context.Context) error
+	// MigrationTableExistsContext reports whether the migrations table exists, without creating it
+	MigrationTableExistsContext(ctx context.Context) (bool, error)
+	GetLatestFailedMigrationContext(ctx context.Context) (*model.Migration, error)
+	GetMigrationsContext(ctx context.Context) ([]model.Migration, error)
+	DeleteMigrationContext(ctx context.Context, id uint) error
+	// ExecTxContext runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise. The other
+	// methods run in the transaction when called with the context passed to fn.
+	ExecTxContext(ctx context.Context, fn func(ctx context.Context, tx *sql.Tx) error) error
+	LockContext(ctx context.Context) error
+	Unlock() error
 	Close() error
 }
 
 type FSUtils interface {
 	GetMigrationFileList(migrationsDir string) (fsutils.DirElements, error)
+	GetCallbackFileList(migrationsDir string) (fsutils.DirElements, error)
+	GetRepeatableFileList(migrationsDir string) (fsutils.DirElements, error)
 	ReadFileContent(pathToFile string) (string, error)
+	CreateFile(pathToFile, content string) error
 }
 
 type Service struct {
-	logger        *zap.Logger
-	store         Store
-	fsUtils       FSUtils
-	migrationPath string
+	logger          *zap.Logger
+	store           Store
+	fsUtils         FSUtils
+	migrationPath   string
+	fsys            fs.FS
+	dryRunOutput    io.Writer
+	numbering       Numbering
+	allowOutOfOrder bool
+	unversioned     UnversionedPolicy
+	goMigrations    map[string]GoMigrationFunc
+	templateVars    map[string]string
+	splitStatements bool
+	template        string
+	metrics         *Metrics
+	now             func() time.Time
+}
+
+// Option configures optional behaviour of the migrator service
+type Option func(s *Service)
+
+// WithDryRun makes Up() and UpTo() write the plan of pending migrations to w instead of running them. The database
+// isn't changed, not even the migrations table is created.
+func WithDryRun(w io.Writer) Option {
+	return func(s *Service) {
+		s.dryRunOutput = w
+	}
+}
+
+// WithFS makes the service read migration files from fsys instead of the OS file system, e.g. from an embed.FS. The
+// migration path passed to New is then interpreted relative to the root of fsys.
+func WithFS(fsys fs.FS) Option {
+	return func(s *Service) {
+		s.fsys = fsys
+	}
+}
+
+// UnversionedPolicy decides what happens to migration files whose name doesn't start with a version, e.g. 003_foo.sql
+type UnversionedPolicy = fsutils.UnversionedPolicy
+
+const (
+	// RejectUnversioned makes all commands fail with ErrUnversionedFile if such a file exists. This is the default.
+	RejectUnversioned = fsutils.RejectUnversioned
+	// IgnoreUnversioned leaves such files out, logging a warning
+	IgnoreUnversioned = fsutils.IgnoreUnversioned
+)
+
+var (
+	// ErrUnversionedFile means a migration file doesn't start with a version, see WithUnversionedFiles
+	ErrUnversionedFile = fsutils.ErrUnversionedFile
+	// ErrDuplicateVersion means two migration files have the same version, e.g. 003_foo.sql and 3_bar.sql
+	ErrDuplicateVersion = fsutils.ErrDuplicateVersion
+)
+
+// WithUnversionedFiles sets what happens to migration files whose name doesn't start with a version
+func WithUnversionedFiles(policy UnversionedPolicy) Option {
+	return func(s *Service) {
+		s.unversioned = policy
+	}
 }
 
-// New returns a new migrator service
-func New(logger *zap.Logger, store Store, migrationPath string, skipDownFiles bool) *Service {
-	return &Service{
+// New returns a new migrator service. Down files like 001_foo.down.sql are never run as migrations, skipDownFiles
+// also leaves out every other file ending in "down.sql".
+func New(logger *zap.Logger, store Store, migrationPath string, skipDownFiles bool, opts ...Option) *Service {
+	s := &Service{
 		logger:        logger,
 		store:         store,
-		fsUtils:       &fsutils.FsUtils{SkipDownFiles: skipDownFiles},
 		migrationPath: strings.TrimPrefix(migrationPath, "file://"),
+		now:           time.Now,
+		goMigrations:  registered(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.fsUtils = &fsutils.FsUtils{SkipDownFiles: skipDownFiles, Unversioned: s.unversioned, FS: s.fsys, Logger: logger}
+	return s
 }
 
+// Up applies all pending migrations in order.
 func (s *Service) Up() error {
-	if err := s.store.EnsureMigrationTableExists(); err != nil {
+	return s.UpContext(context.Background())
+}
+
+// UpContext is like Up, but stops once ctx is done. A migration that is cancelled while running is rolled back along
+// with its transaction, unless it opts out of transactions.
+func (s *Service) UpContext(ctx context.Context) error {
+	return s.up(ctx, "")
+}
+
+// UpTo applies pending migrations in order up to and including the target, which is either a filename or a numeric
+// version prefix (e.g. "3" for 003_foo.sql). Migrations after the target are left pending.
+func (s *Service) UpTo(target string) error {
+	return s.UpToContext(context.Background(), target)
+}
+
+// UpToContext is like UpTo, but stops once ctx is done, see UpContext
+func (s *Service) UpToContext(ctx context.Context, target string) error {
+	if target == "" {
+		return fmt.Errorf("%w: empty target", ErrTargetNotFound)
+	}
+	return s.up(ctx, target)
+}
+
+func (s *Service) up(ctx context.Context, target string) error {
+	if s.dryRunOutput != nil {
+		plan, err := s.planReadOnly(ctx, target)
+		if err != nil {
+			return err
+		}
+		s.logger.Info("dry run: not executing pending migrations", zap.Int("pending", len(plan.all())))
+		return plan.Print(s.dryRunOutput)
+	}
+
+	return s.withLock(ctx, func() error {
+		defer s.observeState(ctx)
+		return s.runPlan(ctx, target)
+	})
+}
+
+func (s *Service) runPlan(ctx context.Context, target string) error {
+	plan, err := s.planUpTo(ctx, target, true)
+	if err != nil {
+		return err
+	}
+	s.observeSkipped(plan.Applied)
+	if len(plan.all()) == 0 {
+		return nil
+	}
+	cbs, err := s.loadCallbacks()
+	if err != nil {
+		return err
+	}
+
+	if err := s.runCallback(ctx, cbs, fsutils.CallbackBeforeAll); err != nil {
+		return err
+	}
+	for _, planned := range plan.all() {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped before running migration %s: %w", planned.Filename, err)
+		}
+		s.logger.Info("running migration", zap.String("filename", planned.Filename))
+		start := time.Now()
+		migration, err := s.runMigration(ctx, planned, cbs)
+		s.observeMigration(start, err)
+		if err != nil {
+			return fmt.Errorf("failed to run migration %s: %w", planned.Filename, err)
+		}
+
+		s.logger.Info("migration has run successfully", zap.Any("migration", migration))
+	}
+
+	return s.runCallback(ctx, cbs, fsutils.CallbackAfterAll)
+}
+
+// Down rolls back the n most recently applied migrations, newest first. Every migration is rolled back by running
+// its paired down file (001_foo.sql or 001_foo.up.sql -> 001_foo.down.sql) and removing it from the migrations table.
+func (s *Service) Down(n int) error {
+	return s.DownContext(context.Background(), n)
+}
+
+// DownContext is like Down, but stops once ctx is done
+func (s *Service) DownContext(ctx context.Context, n int) error {
+	if n < 1 {
+		return fmt.Errorf("%w: got %d", ErrInvalidSteps, n)
+	}
+	return s.withLock(ctx, func() error {
+		return s.down(ctx, n)
+	})
+}
+
+func (s *Service) down(ctx context.Context, n int) error {
+	if err := s.store.EnsureMigrationTableExistsContext(ctx); err != nil {
+		return fmt.Errorf("failed to ensure migrations table exists: %w", err)
+	}
+	if migration, err := s.ensureNoDirtyMigrationsExist(ctx); err != nil {
+		return fmt.Errorf("dirty migration %s found: %w", migration.Filename, err)
+	}
+
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	migrations = rollbackable(migrations)
+	if n > len(migrations) {
+		s.logger.Warn("fewer migrations applied than requested to roll back",
+			zap.Int("requested", n), zap.Int("applied", len(migrations)))
+		n = len(migrations)
+	}
+
+	return s.rollback(ctx, migrations[len(migrations)-n:])
+}
+
+// DownTo rolls back all migrations that were applied after the target, newest first. The target itself, which is
+// either a filename or a numeric version prefix (e.g. "3" for 003_foo.sql), stays applied.
+func (s *Service) DownTo(target string) error {
+	return s.DownToContext(context.Background(), target)
+}
+
+// DownToContext is like DownTo, but stops once ctx is done
+func (s *Service) DownToContext(ctx context.Context, target string) error {
+	return s.withLock(ctx, func() error {
+		return s.downTo(ctx, target)
+	})
+}
+
+func (s *Service) downTo(ctx context.Context, target string) error {
+	if err := s.store.EnsureMigrationTableExistsContext(ctx); err != nil {
 		return fmt.Errorf("failed to ensure migrations table exists: %w", err)
 	}
-	if migration, err := s.ensureNoDirtyMigrationsExist(); err != nil {
+	if migration, err := s.ensureNoDirtyMigrationsExist(ctx); err != nil {
 		return fmt.Errorf("dirty migration %s found: %w", migration.Filename, err)
 	}
 
-	// todo: rw-lock migrations table ?
-	files, err := s.fsUtils.GetMigrationFileList(s.migrationPath)
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	migrations = rollbackable(migrations)
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if matchesTarget(migrations[i].Filename, target) {
+			if i == len(migrations)-1 {
+				s.logger.Info("target is the most recently applied migration, nothing to roll back", zap.String("target", target))
+				return nil
+			}
+			return s.rollback(ctx, migrations[i+1:])
+		}
+	}
+
+	return fmt.Errorf("%w: %s has not been applied", ErrTargetNotFound, target)
+}
+
+// rollback rolls back the given migrations, newest first
+func (s *Service) rollback(ctx context.Context, migrations []model.Migration) error {
+	// read all down files before touching the database, so we don't stop halfway through because of a missing file
+	var err error
+	downSQL := make([]string, len(migrations))
+	for i, migration := range migrations {
+		if downSQL[i], err = s.readDownFile(migration.Filename); err != nil {
+			return err
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped before rolling back migration %s: %w", migration.Filename, err)
+		}
+		s.logger.Info("rolling back migration", zap.String("filename", migration.Filename))
+		if err := s.rollbackMigration(ctx, migration, downSQL[i]); err != nil {
+			return fmt.Errorf("failed to roll back migration %s: %w", migration.Filename, err)
+		}
+		s.logger.Info("migration has been rolled back successfully", zap.String("filename", migration.Filename))
+	}
+
+	return nil
+}
+
+// Redo rolls back the most recently applied migration and applies it again.
+func (s *Service) Redo() error {
+	return s.RedoContext(context.Background())
+}
+
+// RedoContext is like Redo, but stops once ctx is done
+func (s *Service) RedoContext(ctx context.Context) error {
+	return s.withLock(ctx, func() error {
+		return s.redo(ctx)
+	})
+}
+
+func (s *Service) redo(ctx context.Context) error {
+	if err := s.store.EnsureMigrationTableExistsContext(ctx); err != nil {
+		return fmt.Errorf("failed to ensure migrations table exists: %w", err)
+	}
+	if migration, err := s.ensureNoDirtyMigrationsExist(ctx); err != nil {
+		return fmt.Errorf("dirty migration %s found: %w", migration.Filename, err)
+	}
+
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	migrations = rollbackable(migrations)
+	if len(migrations) == 0 {
+		return ErrNoMigrationsApplied
+	}
+	latest := migrations[len(migrations)-1]
+
+	// read both files before touching the database
+	downSQL, err := s.readDownFile(latest.Filename)
+	if err != nil {
+		return err
+	}
+	up := PlannedMigration{Filename: latest.Filename, fn: s.goMigrations[latest.Filename]}
+	if up.fn == nil {
+		if up.source, err = s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, latest.Filename)); err != nil {
+			return fmt.Errorf("failed to read migration file %s: %w", latest.Filename, err)
+		}
+		if up.SQL, err = s.render(latest.Filename, up.source); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Info("rolling back migration", zap.String("filename", latest.Filename))
+	if err := s.rollbackMigration(ctx, latest, downSQL); err != nil {
+		return fmt.Errorf("failed to roll back migration %s: %w", latest.Filename, err)
+	}
+
+	s.logger.Info("running migration", zap.String("filename", latest.Filename))
+	migration, err := s.runMigration(ctx, up, nil)
+	if err != nil {
+		return fmt.Errorf("failed to run migration %s: %w", latest.Filename, err)
+	}
+
+	s.logger.Info("migration has been redone successfully", zap.Any("migration", migration))
+	return nil
+}
+
+// Validate checks the migration files and the migrations table for problems that would keep Up() from succeeding,
+// without changing anything in the database, see Status(). All problems found are returned joined into a single error.
+func (s *Service) Validate() error {
+	return s.ValidateContext(context.Background())
+}
+
+// ValidateContext is like Validate, but stops once ctx is done
+func (s *Service) ValidateContext(ctx context.Context) error {
+	ro, err := s.readOnly(ctx)
+	if err != nil {
+		return err
+	}
+	return ro.validate(ctx)
+}
+
+func (s *Service) validate(ctx context.Context) error {
+	files, err := s.migrationFiles()
 	if err != nil {
 		return fmt.Errorf("failed to get migration file list in dir %s: %w", s.migrationPath, err)
 	}
-	for _, file := range files {
-		s.logger.Info("running migration", zap.String("filename", file.Name()))
+	repeatables, err := s.fsUtils.GetRepeatableFileList(s.migrationPath)
+	if err != nil {
+		return fmt.Errorf("failed to get repeatable migration file list in dir %s: %w", s.migrationPath, err)
+	}
 
-		if wasRun, err := s.wasMigrationPreviouslyRun(file.Name()); err != nil {
-			return fmt.Errorf("failed to check if migration %s was previously run: %w", file.Name(), err)
-		} else if wasRun {
-			s.logger.Info("Skipped: skipping migration, already run", zap.String("filename", file.Name()))
+	var problems []error
+	onDisk := make(map[string]bool, len(files)+len(repeatables))
+	for _, file := range append(files, repeatables...) {
+		onDisk[file.Name()] = true
+		if s.goMigrations[file.Name()] != nil {
 			continue
 		}
-
-		s.logger.Info("running migration", zap.String("filename", file.Name()))
 		rawSQL, err := s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, file.Name()))
 		if err != nil {
-			return fmt.Errorf("failed to read migration file %s: %w", file.Name(), err)
+			problems = append(problems, fmt.Errorf("failed to read migration file %s: %w", file.Name(), err))
+		} else if _, err := s.render(file.Name(), rawSQL); err != nil {
+			problems = append(problems, err)
 		}
+	}
+	if _, err := s.loadCallbacks(); err != nil {
+		problems = append(problems, err)
+	}
 
-		migration, err := s.runMigration(file.Name(), rawSQL)
-		if err != nil {
-			return fmt.Errorf("failed to run migration %s: %w", file.Name(), err)
+	if migration, err := s.ensureNoDirtyMigrationsExist(ctx); err != nil {
+		problems = append(problems, fmt.Errorf("dirty migration %s found: %w", migration.Filename, err))
+	}
+
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	modified, _, err := s.compareChecksums(migrations)
+	if err != nil {
+		return err
+	}
+	for _, drift := range modified {
+		problems = append(problems, drift.err())
+	}
+	for _, migration := range migrations {
+		_, _, versioned := fsutils.Version(migration.Filename)
+		if !versioned && !fsutils.IsRepeatable(migration.Filename) && s.unversioned == IgnoreUnversioned {
+			continue // applied by an older version, which ran unversioned files as well
+		}
+		if !onDisk[migration.Filename] {
+			problems = append(problems, fmt.Errorf("%w: %s is in the migrations table but not in %s",
+				ErrMissingMigrationFile, migration.Filename, s.migrationPath))
 		}
+	}
 
-		s.logger.Info("migration has run successfully", zap.Any("migration", migration))
+	return errors.Join(problems...)
+}
+
+// withLock runs fn while holding the store's migration lock, so that concurrent processes don't run migrations at once
+func (s *Service) withLock(ctx context.Context, fn func() error) error {
+	if err := s.store.LockContext(ctx); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
 	}
+	defer func() {
+		if err := s.store.Unlock(); err != nil {
+			s.logger.Error("failed to release migration lock", zap.Error(err))
+		}
+	}()
 
-	return nil
+	return fn()
 }
 
 func (s *Service) Close() (error, error) {
 	return nil, s.store.Close() // two errors, to comply with golang-migrate's interface for the migrator's Close() method
 }
 
-func (s *Service) runMigration(filename, rawSQL string) (model.Migration, error) {
-	migration, err := s.store.InsertMigration(filename)
+// runMigration records and executes the migration. Unless the migration opts out via the no-transaction directive,
+// both happen in a single transaction, so a failing migration leaves neither a half-applied schema nor a dirty row. Go
+// migrations always run in a transaction. The beforeEach and afterEach callbacks, if any, run along with the migration.
+// A repeatable migration that is run again updates its existing row instead, which keeps its old checksum if it fails.
+func (s *Service) runMigration(ctx context.Context, planned PlannedMigration, cbs callbacks) (model.Migration, error) {
+	var migration model.Migration
+	useTransaction := planned.fn != nil || s.useTransaction(planned.Filename, planned.SQL)
+	err := s.inTransaction(ctx, useTransaction, func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		if planned.previous != nil {
+			migration = *planned.previous
+			if err = s.store.RestartMigrationContext(ctx, migration.ID); err != nil {
+				return fmt.Errorf("failed to update migrations table: %w", err)
+			}
+		} else if migration, err = s.store.InsertMigrationContext(ctx, planned.Filename, planned.checksum()); err != nil {
+			return fmt.Errorf("failed to insert migration into migrations table: %w", err)
+		}
+
+		if err = s.runCallback(ctx, cbs, fsutils.CallbackBeforeEach); err != nil {
+			return err
+		}
+		if planned.fn != nil {
+			err = planned.fn(ctx, tx)
+		} else {
+			err = s.execSQL(ctx, planned.Filename, planned.SQL)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to execute migration: %w", err)
+		}
+		if err = s.runCallback(ctx, cbs, fsutils.CallbackAfterEach); err != nil {
+			return err
+		}
+
+		if planned.previous != nil {
+			if err = s.store.UpdateChecksumContext(ctx, migration.ID, planned.checksum()); err != nil {
+				return fmt.Errorf("failed to update migrations table: %w", err)
+			}
+		}
+		if migration, err = s.store.MarkMigrationCompletedContext(ctx, migration.ID); err != nil {
+			return fmt.Errorf("failed to update migrations table: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return model.Migration{}, fmt.Errorf("failed to insert migration into migrations table: %w", err)
+		return model.Migration{}, err
 	}
 
-	if err := s.store.RawExec(rawSQL); err != nil {
-		return model.Migration{}, fmt.Errorf("failed to execute migration: %w", err)
+	return migration, nil
+}
+
+func (s *Service) rollbackMigration(ctx context.Context, migration model.Migration, rawSQL string) error {
+	return s.inTransaction(ctx, s.useTransaction(downFileName(migration.Filename), rawSQL), func(ctx context.Context, _ *sql.Tx) error {
+		if err := s.execSQL(ctx, downFileName(migration.Filename), rawSQL); err != nil {
+			return fmt.Errorf("failed to execute down migration: %w", err)
+		}
+
+		if err := s.store.DeleteMigrationContext(ctx, migration.ID); err != nil {
+			return fmt.Errorf("failed to delete migration from migrations table: %w", err)
+		}
+		return nil
+	})
+}
+
+// useTransaction reports whether a migration file is run in a transaction. Files opt out with the no-transaction
+// directive. Files that begin their own transaction, like the ones written before migrations were wrapped in one, are
+// run as they are as well, since a nested BEGIN either fails or commits the wrapping transaction early.
+func (s *Service) useTransaction(filename, rawSQL string) bool {
+	if hasDirective(rawSQL, directiveNoTransaction) {
+		return false
+	}
+	if beginsTransaction(rawSQL) {
+		s.logger.Info("migration begins its own transaction, running it outside of one", zap.String("filename", filename))
+		return false
 	}
+	return true
+}
 
-	if migration, err = s.store.MarkMigrationCompleted(migration.ID); err != nil {
-		return model.Migration{}, fmt.Errorf("failed to update migrations table: %w", err)
+// inTransaction runs fn inside a store transaction, which is rolled back if fn fails. fn has to pass the context it
+// is called with to the store, so that its calls run in the transaction. If useTransaction is false, fn is run as is,
+// with a nil transaction.
+func (s *Service) inTransaction(ctx context.Context, useTransaction bool, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	if !useTransaction {
+		return fn(ctx, nil)
 	}
+	return s.store.ExecTxContext(ctx, fn)
+}
 
-	return migration, nil
+func (s *Service) readDownFile(filename string) (string, error) {
+	downFilename := downFileName(filename)
+	rawSQL, err := s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, downFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s (needed to roll back %s)", ErrDownMigrationNotFound, downFilename, filename)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read down migration file %s: %w", downFilename, err)
+	}
+	return s.render(downFilename, rawSQL)
+}
+
+// truncateAtTarget returns the files up to and including the last one matching the target
+func truncateAtTarget(files fsutils.DirElements, target string) (fsutils.DirElements, error) {
+	for i := len(files) - 1; i >= 0; i-- {
+		if matchesTarget(files[i].Name(), target) {
+			return files[:i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no migration file matches %s", ErrTargetNotFound, target)
 }
 
-func (s *Service) wasMigrationPreviouslyRun(filename string) (bool, error) {
-	hasRun, err := s.store.HasMigrationRun(filename)
+// matchesTarget reports whether the migration file is the given target, which is either the exact filename or its
+// version, ignoring leading zeros (i.e. "3", "03" and "003_foo.sql" all match 003_foo.sql)
+func matchesTarget(filename, target string) bool {
+	if filename == target {
+		return true
+	}
+	want, err := strconv.ParseUint(target, 10, 64)
 	if err != nil {
-		return false, fmt.Errorf("failed to check if migration %s was previously run: %w", filename, err)
+		return false
 	}
-	return hasRun, nil
+
+	version, _, ok := fsutils.Version(filename)
+	return ok && version == want
+}
+
+// downFileName returns the name of the file that rolls back the given migration, i.e. 001_foo.down.sql for both
+// 001_foo.sql and 001_foo.up.sql
+func downFileName(filename string) string {
+	base := strings.TrimSuffix(filename, ".sql")
+	base = strings.TrimSuffix(base, ".up")
+	return base + fsutils.DownSuffix
 }
 
-func (s *Service) ensureNoDirtyMigrationsExist() (model.Migration, error) {
-	migration, err := s.store.GetLatestFailedMigration()
+func (s *Service) ensureNoDirtyMigrationsExist(ctx context.Context) (model.Migration, error) {
+	migration, err := s.store.GetLatestFailedMigrationContext(ctx)
 	if err != nil {
 		return model.Migration{}, fmt.Errorf("failed to check whether any dirty migrations exist: %w", err)
 	}
@@ -1,10 +1,19 @@
 package migrator
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/jackc/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"github.com/ymakhloufi/litemigrate/internal/pkg/fsutils"
 	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
@@ -33,7 +42,7 @@ func TestService_runMigration(t *testing.T) {
 				rawSQL:   "myRawSQL",
 			},
 			store: &storeMock{
-				InsertMigrationFunc: func(filename string) (model.Migration, error) {
+				InsertMigrationFunc: func(filename, checksum string) (model.Migration, error) {
 					require.Equal(t, "myFilename", filename)
 					return model.Migration{ID: uint(1234)}, nil
 				},
@@ -51,12 +60,70 @@ func TestService_runMigration(t *testing.T) {
 				insertMigrationCalls:        1,
 				rawExecCalls:                1,
 				markMigrationCompletedCalls: 1,
+				execTxCalls:                 1,
 			},
 		},
+		{
+			name: "runs outside a transaction when the migration opts out",
+			args: args{
+				filename: "myFilename",
+				rawSQL:   "-- litemigrate:no-transaction\nCREATE INDEX CONCURRENTLY foo ON bar (baz)",
+			},
+			store: &storeMock{
+				InsertMigrationFunc:        func(filename, checksum string) (model.Migration, error) { return model.Migration{ID: uint(1234)}, nil },
+				RawExecFunc:                func(rawSql string) error { return nil },
+				MarkMigrationCompletedFunc: func(id uint) (model.Migration, error) { return model.Migration{ID: id}, nil },
+			},
+			want: model.Migration{ID: uint(1234)},
+			wantStoreCalls: &storeMock{
+				insertMigrationCalls:        1,
+				rawExecCalls:                1,
+				markMigrationCompletedCalls: 1,
+			},
+		},
+		{
+			name: "runs outside a transaction when the migration begins its own",
+			args: args{
+				filename: "myFilename",
+				rawSQL:   "-- written for an older version\nBEGIN;\nCREATE TABLE foo (id int);\nCOMMIT;",
+			},
+			store: &storeMock{
+				InsertMigrationFunc:        func(filename, checksum string) (model.Migration, error) { return model.Migration{ID: uint(1234)}, nil },
+				RawExecFunc:                func(rawSql string) error { return nil },
+				MarkMigrationCompletedFunc: func(id uint) (model.Migration, error) { return model.Migration{ID: id}, nil },
+			},
+			want: model.Migration{ID: uint(1234)},
+			wantStoreCalls: &storeMock{
+				insertMigrationCalls:        1,
+				rawExecCalls:                1,
+				markMigrationCompletedCalls: 1,
+			},
+		},
+		{
+			name: "returns error when the transaction can't be committed",
+			store: &storeMock{
+				InsertMigrationFunc:        func(filename, checksum string) (model.Migration, error) { return model.Migration{ID: uint(1234)}, nil },
+				RawExecFunc:                func(rawSql string) error { return nil },
+				MarkMigrationCompletedFunc: func(id uint) (model.Migration, error) { return model.Migration{ID: id}, nil },
+				ExecTxFunc: func(fn func(ctx context.Context, tx *sql.Tx) error) error {
+					if err := fn(context.Background(), nil); err != nil {
+						return err
+					}
+					return myErr
+				},
+			},
+			wantStoreCalls: &storeMock{
+				insertMigrationCalls:        1,
+				rawExecCalls:                1,
+				markMigrationCompletedCalls: 1,
+				execTxCalls:                 1,
+			},
+			wantErr: myErr,
+		},
 		{
 			name: "doesn't call rawExec when insertion fails",
 			store: &storeMock{
-				InsertMigrationFunc: func(filename string) (model.Migration, error) {
+				InsertMigrationFunc: func(filename, checksum string) (model.Migration, error) {
 					return model.Migration{}, myErr
 				},
 				RawExecFunc: func(rawSql string) error {
@@ -71,13 +138,14 @@ func TestService_runMigration(t *testing.T) {
 				insertMigrationCalls:          1,
 				rawExecCalls:                  0,
 				getLatestFailedMigrationCalls: 0,
+				execTxCalls:                   1,
 			},
 			wantErr: myErr,
 		},
 		{
 			name: "doesn't call markCompleted when execution fails",
 			store: &storeMock{
-				InsertMigrationFunc: func(filename string) (model.Migration, error) {
+				InsertMigrationFunc: func(filename, checksum string) (model.Migration, error) {
 					return model.Migration{ID: uint(1234)}, nil
 				},
 				RawExecFunc: func(rawSql string) error {
@@ -91,6 +159,7 @@ func TestService_runMigration(t *testing.T) {
 				insertMigrationCalls:          1,
 				rawExecCalls:                  1,
 				getLatestFailedMigrationCalls: 0,
+				execTxCalls:                   1,
 			},
 			wantErr: myErr,
 		},
@@ -98,7 +167,7 @@ func TestService_runMigration(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Service{logger: zap.NewNop(), store: tt.store}
-			got, err := s.runMigration(tt.args.filename, tt.args.rawSQL)
+			got, err := s.runMigration(context.Background(), PlannedMigration{Filename: tt.args.filename, SQL: tt.args.rawSQL}, nil)
 			require.ErrorIs(t, err, tt.wantErr)
 			require.Equal(t, tt.want, got)
 
@@ -108,6 +177,7 @@ func TestService_runMigration(t *testing.T) {
 			require.Equal(t, tt.wantStoreCalls.rawExecCalls, tt.store.(*storeMock).rawExecCalls)
 			require.Equal(t, tt.wantStoreCalls.markMigrationCompletedCalls, tt.store.(*storeMock).markMigrationCompletedCalls)
 			require.Equal(t, tt.wantStoreCalls.ensureMigrationTableExistsCalls, tt.store.(*storeMock).ensureMigrationTableExistsCalls)
+			require.Equal(t, tt.wantStoreCalls.execTxCalls, tt.store.(*storeMock).execTxCalls)
 		})
 	}
 }
@@ -155,7 +225,7 @@ func TestService_ensureNoDirtyMigrationsExist(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Service{logger: zap.NewNop(), store: tt.store}
-			migration, err := s.ensureNoDirtyMigrationsExist()
+			migration, err := s.ensureNoDirtyMigrationsExist(context.Background())
 			require.ErrorIs(t, err, tt.wantErr)
 			require.Equal(t, tt.wantModel, migration)
 		})
@@ -178,8 +248,8 @@ func TestService_Run(t *testing.T) {
 			store: &storeMock{
 				EnsureMigrationTableExistsFunc: func() error { return nil },
 				GetLatestFailedMigrationFunc:   func() (*model.Migration, error) { return nil, nil },
-				InsertMigrationFunc:            func(filename string) (model.Migration, error) { return model.Migration{ID: uint(1234)}, nil },
-				HasMigrationRunFunc:            func(filename string) (bool, error) { return false, nil },
+				GetMigrationsFunc:              func() ([]model.Migration, error) { return nil, nil },
+				InsertMigrationFunc:            func(filename, checksum string) (model.Migration, error) { return model.Migration{ID: uint(1234)}, nil },
 				RawExecFunc: func(rawSql string) error {
 					require.Equal(t, "select * from foo", rawSql)
 					return nil
@@ -195,7 +265,6 @@ func TestService_Run(t *testing.T) {
 				insertMigrationCalls:            2,
 				rawExecCalls:                    2,
 				markMigrationCompletedCalls:     2,
-				hasMigrationRunCalls:            2,
 			},
 			fsUtils: &fsUtilsMock{
 				GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
@@ -237,6 +306,7 @@ func TestService_Run(t *testing.T) {
 			store: &storeMock{
 				EnsureMigrationTableExistsFunc: func() error { return nil },
 				GetLatestFailedMigrationFunc:   func() (*model.Migration, error) { return nil, nil },
+				GetMigrationsFunc:              func() ([]model.Migration, error) { return nil, nil },
 			},
 			fsUtils: &fsUtilsMock{GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) { return nil, myErr }},
 			wantStoreCalls: &storeMock{
@@ -250,11 +320,13 @@ func TestService_Run(t *testing.T) {
 			store: &storeMock{
 				EnsureMigrationTableExistsFunc: func() error { return nil },
 				GetLatestFailedMigrationFunc:   func() (*model.Migration, error) { return nil, nil },
-				HasMigrationRunFunc:            func(filename string) (bool, error) { return filename == "2.sql", nil },
-				RawExecFunc:                    func(rawSql string) error { return nil },
-				MarkMigrationCompletedFunc:     func(id uint) (model.Migration, error) { return model.Migration{}, nil },
-				InsertMigrationFunc: func(filename string) (model.Migration, error) {
-					require.NotEqual(t, "2.sql", filename) // only the first one should run
+				GetMigrationsFunc: func() ([]model.Migration, error) {
+					return []model.Migration{{ID: 1, Filename: "1.sql", Checksum: checksum("select * from foo")}}, nil
+				},
+				RawExecFunc:                func(rawSql string) error { return nil },
+				MarkMigrationCompletedFunc: func(id uint) (model.Migration, error) { return model.Migration{}, nil },
+				InsertMigrationFunc: func(filename, checksum string) (model.Migration, error) {
+					require.NotEqual(t, "1.sql", filename) // only the other ones should run
 					return model.Migration{}, nil
 				},
 			},
@@ -273,7 +345,6 @@ func TestService_Run(t *testing.T) {
 			wantStoreCalls: &storeMock{
 				ensureMigrationTableExistsCalls: 1,
 				getLatestFailedMigrationCalls:   1,
-				hasMigrationRunCalls:            3,
 				insertMigrationCalls:            2,
 				rawExecCalls:                    2,
 				markMigrationCompletedCalls:     2,
@@ -299,3 +370,1305 @@ func TestService_Run(t *testing.T) {
 		})
 	}
 }
+
+func TestService_Down(t *testing.T) {
+	myErr := errors.New("my error")
+	myDir := "myDir"
+	appliedMigrations := []model.Migration{
+		{ID: 1, Filename: "1.sql"},
+		{ID: 2, Filename: "2.up.sql"},
+		{ID: 3, Filename: "3.sql"},
+	}
+
+	tests := []struct {
+		name           string
+		steps          int
+		store          *storeMock
+		fsUtils        *fsUtilsMock
+		wantRolledBack []uint
+		wantExecuted   []string
+		wantErr        error
+	}{
+		{
+			name:  "rolls back the latest migrations in reverse order",
+			steps: 2,
+			store: &storeMock{
+				GetMigrationsFunc: func() ([]model.Migration, error) { return appliedMigrations, nil },
+			},
+			fsUtils: &fsUtilsMock{
+				ReadFileContentFunc: func(pathToFile string) (string, error) { return "undo " + pathToFile, nil },
+			},
+			wantRolledBack: []uint{3, 2},
+			wantExecuted:   []string{"undo myDir/3.down.sql", "undo myDir/2.down.sql"},
+		},
+		{
+			name:  "rolls back everything when more steps than migrations are requested",
+			steps: 10,
+			store: &storeMock{
+				GetMigrationsFunc: func() ([]model.Migration, error) { return appliedMigrations, nil },
+			},
+			fsUtils: &fsUtilsMock{
+				ReadFileContentFunc: func(pathToFile string) (string, error) { return "undo " + pathToFile, nil },
+			},
+			wantRolledBack: []uint{3, 2, 1},
+			wantExecuted:   []string{"undo myDir/3.down.sql", "undo myDir/2.down.sql", "undo myDir/1.down.sql"},
+		},
+		{
+			name:    "returns error on non-positive steps",
+			steps:   0,
+			store:   &storeMock{},
+			wantErr: ErrInvalidSteps,
+		},
+		{
+			name:  "doesn't touch the database when a down file is missing",
+			steps: 2,
+			store: &storeMock{
+				GetMigrationsFunc: func() ([]model.Migration, error) { return appliedMigrations, nil },
+			},
+			fsUtils: &fsUtilsMock{
+				ReadFileContentFunc: func(pathToFile string) (string, error) {
+					if pathToFile == "myDir/2.down.sql" {
+						return "", os.ErrNotExist
+					}
+					return "undo " + pathToFile, nil
+				},
+			},
+			wantErr: ErrDownMigrationNotFound,
+		},
+		{
+			name:  "stops when a down migration fails",
+			steps: 2,
+			store: &storeMock{
+				GetMigrationsFunc: func() ([]model.Migration, error) { return appliedMigrations, nil },
+				RawExecFunc:       func(rawSQL string) error { return myErr },
+			},
+			fsUtils: &fsUtilsMock{
+				ReadFileContentFunc: func(pathToFile string) (string, error) { return "undo " + pathToFile, nil },
+			},
+			wantExecuted: []string{"undo myDir/3.down.sql"},
+			wantErr:      myErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rolledBack []uint
+			var executed []string
+			tt.store.EnsureMigrationTableExistsFunc = func() error { return nil }
+			tt.store.GetLatestFailedMigrationFunc = func() (*model.Migration, error) { return nil, nil }
+			tt.store.DeleteMigrationFunc = func(id uint) error {
+				rolledBack = append(rolledBack, id)
+				return nil
+			}
+			rawExec := tt.store.RawExecFunc
+			tt.store.RawExecFunc = func(rawSQL string) error {
+				executed = append(executed, rawSQL)
+				if rawExec != nil {
+					return rawExec(rawSQL)
+				}
+				return nil
+			}
+
+			s := &Service{logger: zap.NewNop(), store: tt.store, fsUtils: tt.fsUtils, migrationPath: myDir}
+			err := s.Down(tt.steps)
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.wantRolledBack, rolledBack)
+			require.Equal(t, tt.wantExecuted, executed)
+		})
+	}
+}
+
+func TestDownFileName(t *testing.T) {
+	require.Equal(t, "001_foo.down.sql", downFileName("001_foo.sql"))
+	require.Equal(t, "001_foo.down.sql", downFileName("001_foo.up.sql"))
+}
+
+func TestService_Force(t *testing.T) {
+	completedAt := time.Now()
+	migrations := []model.Migration{
+		{ID: 1, Filename: "1.sql", CompletedAt: &completedAt},
+		{ID: 2, Filename: "2.sql"},
+	}
+
+	tests := []struct {
+		name        string
+		filename    string
+		mode        ForceMode
+		wantMarked  uint
+		wantRetried uint
+		wantErr     error
+	}{
+		{name: "marks dirty migration completed", filename: "2.sql", mode: ForceCompleted, wantMarked: 2},
+		{name: "marks dirty migration to retry it", filename: "2.sql", mode: ForceRetry, wantRetried: 2},
+		{name: "returns error for completed migration", filename: "1.sql", mode: ForceRetry, wantErr: ErrMigrationNotDirty},
+		{name: "returns error for unknown migration", filename: "3.sql", mode: ForceCompleted, wantErr: ErrMigrationNotFound},
+		{name: "returns error for unknown mode", filename: "2.sql", mode: "skip", wantErr: ErrInvalidForceMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var marked, retried uint
+			store := &storeMock{
+				EnsureMigrationTableExistsFunc: func() error { return nil },
+				GetMigrationsFunc:              func() ([]model.Migration, error) { return migrations, nil },
+				MarkMigrationForcedFunc: func(id uint, forcedBy string) (model.Migration, error) {
+					require.Equal(t, "jane@laptop", forcedBy)
+					marked = id
+					return model.Migration{ID: id, ForcedBy: forcedBy}, nil
+				},
+				MarkMigrationForRetryFunc: func(id uint, forcedBy string) (model.Migration, error) {
+					require.Equal(t, "jane@laptop", forcedBy) // recorded for retries as well
+					retried = id
+					return model.Migration{ID: id, ForcedBy: forcedBy}, nil
+				},
+			}
+
+			s := &Service{logger: zap.NewNop(), store: store}
+			_, err := s.Force(tt.filename, tt.mode, "jane@laptop")
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.wantMarked, marked)
+			require.Equal(t, tt.wantRetried, retried)
+			require.Zero(t, store.deleteMigrationCalls)
+		})
+	}
+}
+
+func TestService_UpRetriesForcedMigration(t *testing.T) {
+	startedAt := time.Now().Add(-time.Hour)
+	completedAt, forcedAt := startedAt, startedAt.Add(time.Minute)
+	applied := []model.Migration{
+		{ID: 1, Filename: "1.sql", StartedAt: startedAt, CompletedAt: &completedAt, Checksum: checksum("SELECT 1;")},
+		{ID: 2, Filename: "2.sql", StartedAt: startedAt, Checksum: checksum("SELECT broken;"), ForcedBy: "jane@laptop", ForcedAt: &forcedAt},
+	}
+	require.True(t, applied[1].AwaitsRetry())
+	require.False(t, applied[1].IsDirty())
+
+	var restarted, completed uint
+	var executed []string
+	store := newUpStoreMock()
+	store.GetMigrationsFunc = func() ([]model.Migration, error) { return applied, nil }
+	store.RestartMigrationFunc = func(id uint) error {
+		restarted = id
+		return nil
+	}
+	store.UpdateChecksumFunc = func(id uint, sum string) error {
+		require.Equal(t, uint(2), id)
+		require.Equal(t, checksum("SELECT fixed;"), sum)
+		return nil
+	}
+	store.MarkMigrationCompletedFunc = func(id uint) (model.Migration, error) {
+		completed = id
+		return model.Migration{ID: id, ForcedBy: "jane@laptop", ForcedAt: &forcedAt, CompletedAt: &forcedAt}, nil
+	}
+	store.RawExecFunc = func(rawSQL string) error {
+		executed = append(executed, rawSQL)
+		return nil
+	}
+	fsUtils := &fsUtilsMock{
+		GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return fsutils.DirElements{fakeDirElement{name: "1.sql"}, fakeDirElement{name: "2.sql"}}, nil
+		},
+		ReadFileContentFunc: func(pathToFile string) (string, error) {
+			if pathToFile == "myDir/2.sql" {
+				return "SELECT fixed;", nil
+			}
+			return "SELECT 1;", nil
+		},
+	}
+	s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+
+	report, err := s.Status()
+	require.NoError(t, err)
+	require.Equal(t, StatePending, report.Migrations[1].State)
+	require.Equal(t, "jane@laptop", report.Migrations[1].ForcedBy)
+
+	// the migration runs again in its existing row, which keeps who forced it and when
+	require.NoError(t, s.Up())
+	require.Equal(t, []string{"SELECT fixed;"}, executed)
+	require.Equal(t, uint(2), restarted)
+	require.Equal(t, uint(2), completed)
+	require.Zero(t, store.insertMigrationCalls)
+}
+
+func TestService_Validate(t *testing.T) {
+	store := &storeMock{
+		GetLatestFailedMigrationFunc: func() (*model.Migration, error) { return &model.Migration{Filename: "2.sql"}, nil },
+		GetMigrationsFunc: func() ([]model.Migration, error) {
+			return []model.Migration{{ID: 1, Filename: "1.sql"}, {ID: 2, Filename: "2.sql"}, {ID: 3, Filename: "gone.sql"}}, nil
+		},
+	}
+	fsUtils := &fsUtilsMock{
+		GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return []os.DirEntry{fakeDirElement{name: "1.sql"}, fakeDirElement{name: "2.sql"}}, nil
+		},
+		ReadFileContentFunc: func(pathToFile string) (string, error) { return "select 1", nil },
+	}
+
+	s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+	err := s.Validate()
+	require.ErrorIs(t, err, ErrDirtyMigrationExists)
+	require.ErrorIs(t, err, ErrMissingMigrationFile)
+	require.ErrorContains(t, err, "gone.sql")
+	require.Zero(t, store.ensureMigrationTableExistsCalls)
+	require.Zero(t, store.lockCalls)
+
+	t.Run("doesn't miss ignored unversioned files applied by older versions", func(t *testing.T) {
+		store := &storeMock{
+			GetLatestFailedMigrationFunc: func() (*model.Migration, error) { return nil, nil },
+			GetMigrationsFunc: func() ([]model.Migration, error) {
+				return []model.Migration{{ID: 1, Filename: "1.sql"}, {ID: 2, Filename: "init.sql"}, {ID: 3, Filename: "R__gone.sql"}}, nil
+			},
+		}
+		s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir", unversioned: IgnoreUnversioned}
+		err := s.Validate()
+		require.ErrorIs(t, err, ErrMissingMigrationFile)
+		require.ErrorContains(t, err, "R__gone.sql")
+		require.NotContains(t, err.Error(), "init.sql")
+	})
+}
+
+func TestService_Create(t *testing.T) {
+	now := time.Date(2024, 1, 31, 15, 45, 0, 0, time.FixedZone("CET", 3600))
+
+	tests := []struct {
+		name          string
+		migrationName string
+		opts          []Option
+		existingFiles []string
+		want          []string
+		wantContent   []string
+		wantErr       error
+	}{
+		{
+			name:          "starts at one in an empty directory",
+			migrationName: "create users",
+			want:          []string{"myDir/001_create_users.up.sql", "myDir/001_create_users.down.sql"},
+			wantContent:   []string{"", ""},
+		},
+		{
+			name:          "continues after the highest sequence number and keeps its padding",
+			migrationName: "Add-Index",
+			existingFiles: []string{"0001_foo.sql", "0009_bar.up.sql", "0009_bar.down.sql", "readme.sql"},
+			want:          []string{"myDir/0010_add_index.up.sql", "myDir/0010_add_index.down.sql"},
+			wantContent:   []string{"", ""},
+		},
+		{
+			name:          "uses the current UTC time with timestamp numbering",
+			migrationName: "add index",
+			opts:          []Option{WithNumbering(NumberingTimestamp)},
+			existingFiles: []string{"001_foo.sql"},
+			want:          []string{"myDir/20240131144500_add_index.up.sql", "myDir/20240131144500_add_index.down.sql"},
+			wantContent:   []string{"", ""},
+		},
+		{
+			name:          "keeps timestamps ordered when a file with the same timestamp exists",
+			migrationName: "add index",
+			opts:          []Option{WithNumbering(NumberingTimestamp)},
+			existingFiles: []string{"20240131144500_foo.sql"},
+			want:          []string{"myDir/20240131144501_add_index.up.sql", "myDir/20240131144501_add_index.down.sql"},
+			wantContent:   []string{"", ""},
+		},
+		{
+			name:          "fills the files from the template",
+			migrationName: "add index",
+			opts:          []Option{WithTemplate("-- {{.Version}} {{.Name}} ({{.Direction}})\n")},
+			want:          []string{"myDir/001_add_index.up.sql", "myDir/001_add_index.down.sql"},
+			wantContent:   []string{"-- 001 add_index (up)\n", "-- 001 add_index (down)\n"},
+		},
+		{
+			name:          "rejects templates referring to unknown fields",
+			migrationName: "add index",
+			opts:          []Option{WithTemplate("{{.Author}}")},
+			want:          []string{},
+			wantErr:       ErrInvalidTemplate,
+		},
+		{
+			name:          "rejects unknown numbering",
+			migrationName: "add index",
+			opts:          []Option{WithNumbering("random")},
+			wantErr:       ErrInvalidNumbering,
+		},
+		{
+			name:          "rejects names without any usable characters",
+			migrationName: " -- ",
+			wantErr:       ErrInvalidMigrationName,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var created, content []string
+			fsUtils := &fsUtilsMock{
+				GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+					list := fsutils.DirElements{}
+					for _, name := range tt.existingFiles {
+						list = append(list, fakeDirElement{name: name})
+					}
+					return list, nil
+				},
+				CreateFileFunc: func(pathToFile, fileContent string) error {
+					created = append(created, pathToFile)
+					content = append(content, fileContent)
+					return nil
+				},
+			}
+
+			s := &Service{logger: zap.NewNop(), fsUtils: fsUtils, migrationPath: "myDir", now: func() time.Time { return now }}
+			for _, opt := range tt.opts {
+				opt(s)
+			}
+			got, err := s.Create(tt.migrationName)
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.want, got)
+			if tt.wantErr == nil {
+				require.Equal(t, tt.want, created)
+				require.Equal(t, tt.wantContent, content)
+			}
+		})
+	}
+}
+
+func TestService_Status(t *testing.T) {
+	startedAt := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	completedAt := startedAt.Add(time.Second)
+	sum := checksum("select 1")
+
+	store := &storeMock{
+		GetMigrationsFunc: func() ([]model.Migration, error) {
+			return []model.Migration{
+				{ID: 1, Filename: "1.sql", StartedAt: startedAt, CompletedAt: &completedAt, Checksum: sum},
+				{ID: 2, Filename: "gone.sql", StartedAt: startedAt, CompletedAt: &completedAt, Checksum: sum},
+				{ID: 3, Filename: "2.sql", StartedAt: startedAt},
+				{ID: 4, Filename: "4.sql", StartedAt: startedAt, CompletedAt: &completedAt, Checksum: "abc"},
+			}, nil
+		},
+	}
+	fsUtils := &fsUtilsMock{
+		GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return []os.DirEntry{
+				fakeDirElement{name: "1.sql"},
+				fakeDirElement{name: "2.sql"},
+				fakeDirElement{name: "3.sql"},
+				fakeDirElement{name: "4.sql"},
+				fakeDirElement{name: "5.sql"},
+			}, nil
+		},
+		ReadFileContentFunc: func(pathToFile string) (string, error) {
+			if pathToFile == "myDir/gone.sql" {
+				return "", os.ErrNotExist
+			}
+			return "select 1", nil
+		},
+	}
+
+	s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+	report, err := s.Status()
+	require.NoError(t, err)
+	require.Equal(t, []MigrationStatus{
+		{Filename: "1.sql", State: StateApplied, StartedAt: &startedAt, CompletedAt: &completedAt, Checksum: sum},
+		{Filename: "2.sql", State: StateDirty, StartedAt: &startedAt},
+		{Filename: "3.sql", State: StateOutOfOrder},
+		{Filename: "4.sql", State: StateModified, StartedAt: &startedAt, CompletedAt: &completedAt, Checksum: "abc"},
+		{Filename: "5.sql", State: StatePending},
+		{Filename: "gone.sql", State: StateOrphaned, StartedAt: &startedAt, CompletedAt: &completedAt, Checksum: sum},
+	}, report.Migrations)
+	require.Equal(t, 1, report.Count(StatePending))
+	require.Equal(t, 1, report.Count(StateOutOfOrder))
+	require.Zero(t, store.ensureMigrationTableExistsCalls)
+
+	t.Run("doesn't create a missing migrations table", func(t *testing.T) {
+		store := &storeMock{MigrationTableExistsFunc: func() (bool, error) { return false, nil }}
+
+		s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+		report, err := s.Status()
+		require.NoError(t, err)
+		require.Equal(t, 5, report.Count(StatePending))
+		require.Len(t, report.Migrations, 5)
+		require.Zero(t, store.ensureMigrationTableExistsCalls)
+	})
+}
+
+func TestService_UpTo(t *testing.T) {
+	files := []os.DirEntry{
+		fakeDirElement{name: "001_foo.sql"},
+		fakeDirElement{name: "002_bar.sql"},
+		fakeDirElement{name: "003_baz.sql"},
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		want    []string
+		wantErr error
+	}{
+		{name: "stops at filename", target: "002_bar.sql", want: []string{"001_foo.sql", "002_bar.sql"}},
+		{name: "stops at numeric prefix", target: "1", want: []string{"001_foo.sql"}},
+		{name: "returns error for unknown target without running anything", target: "4", wantErr: ErrTargetNotFound},
+		{name: "returns error for empty target", target: "", wantErr: ErrTargetNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inserted []string
+			store := newUpStoreMock()
+			store.InsertMigrationFunc = func(filename, checksum string) (model.Migration, error) {
+				inserted = append(inserted, filename)
+				return model.Migration{}, nil
+			}
+			fsUtils := &fsUtilsMock{
+				GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) { return files, nil },
+				ReadFileContentFunc:      func(pathToFile string) (string, error) { return "select 1", nil },
+			}
+
+			s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+			err := s.UpTo(tt.target)
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.want, inserted)
+		})
+	}
+}
+
+func TestService_DownTo(t *testing.T) {
+	appliedMigrations := []model.Migration{
+		{ID: 1, Filename: "001_foo.sql"},
+		{ID: 2, Filename: "002_bar.sql"},
+		{ID: 3, Filename: "003_baz.sql"},
+	}
+
+	tests := []struct {
+		name           string
+		target         string
+		wantRolledBack []uint
+		wantErr        error
+	}{
+		{name: "rolls back everything after filename", target: "001_foo.sql", wantRolledBack: []uint{3, 2}},
+		{name: "rolls back everything after numeric prefix", target: "2", wantRolledBack: []uint{3}},
+		{name: "does nothing when target is the latest migration", target: "003"},
+		{name: "returns error when target hasn't been applied", target: "4", wantErr: ErrTargetNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rolledBack []uint
+			store := &storeMock{
+				EnsureMigrationTableExistsFunc: func() error { return nil },
+				GetLatestFailedMigrationFunc:   func() (*model.Migration, error) { return nil, nil },
+				GetMigrationsFunc:              func() ([]model.Migration, error) { return appliedMigrations, nil },
+				RawExecFunc:                    func(rawSQL string) error { return nil },
+				DeleteMigrationFunc: func(id uint) error {
+					rolledBack = append(rolledBack, id)
+					return nil
+				},
+			}
+			fsUtils := &fsUtilsMock{
+				ReadFileContentFunc: func(pathToFile string) (string, error) { return "select 1", nil },
+			}
+
+			s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+			err := s.DownTo(tt.target)
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.wantRolledBack, rolledBack)
+		})
+	}
+}
+
+func TestMatchesTarget(t *testing.T) {
+	require.True(t, matchesTarget("003_foo.sql", "003_foo.sql"))
+	require.True(t, matchesTarget("003_foo.sql", "3"))
+	require.True(t, matchesTarget("003_foo.sql", "0003"))
+	require.False(t, matchesTarget("003_foo.sql", "30"))
+	require.False(t, matchesTarget("003_foo.sql", "003_foo"))
+	require.False(t, matchesTarget("foo.sql", "0"))
+}
+
+func TestService_UpDryRun(t *testing.T) {
+	store := &storeMock{
+		GetLatestFailedMigrationFunc: func() (*model.Migration, error) { return nil, nil },
+		GetMigrationsFunc: func() ([]model.Migration, error) {
+			return []model.Migration{{ID: 1, Filename: "1.sql", Checksum: checksum("select 'myDir/1.sql'")}}, nil
+		},
+	}
+	fsUtils := &fsUtilsMock{
+		GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return []os.DirEntry{fakeDirElement{name: "1.sql"}, fakeDirElement{name: "2.sql"}, fakeDirElement{name: "3.sql"}}, nil
+		},
+		ReadFileContentFunc: func(pathToFile string) (string, error) { return "select '" + pathToFile + "'", nil },
+	}
+	out := &strings.Builder{}
+
+	s := New(zap.NewNop(), store, "myDir", false, WithDryRun(out))
+	s.fsUtils = fsUtils
+	err := s.Up()
+	require.NoError(t, err)
+
+	// the storeMock panics on nil funcs, so any call to EnsureMigrationTableExists, InsertMigration, RawExec or
+	// MarkMigrationCompleted would fail
+	require.Zero(t, store.ensureMigrationTableExistsCalls)
+	require.Zero(t, store.insertMigrationCalls)
+	require.Zero(t, store.rawExecCalls)
+	require.Zero(t, store.markMigrationCompletedCalls)
+	require.Equal(t, "-- 2.sql\nselect 'myDir/2.sql'\n\n"+
+		"-- 3.sql\nselect 'myDir/3.sql'\n\n"+
+		"-- 2 pending migration(s), 1 already applied\n", out.String())
+
+	t.Run("doesn't create a missing migrations table", func(t *testing.T) {
+		store := &storeMock{MigrationTableExistsFunc: func() (bool, error) { return false, nil }}
+		out := &strings.Builder{}
+
+		s := New(zap.NewNop(), store, "myDir", false, WithDryRun(out))
+		s.fsUtils = fsUtils
+		require.NoError(t, s.Up())
+		require.Equal(t, uint(1), store.migrationTableExistsCalls)
+		require.Zero(t, store.ensureMigrationTableExistsCalls)
+		require.Zero(t, store.getMigrationsCalls)
+		require.Equal(t, "-- 1.sql\nselect 'myDir/1.sql'\n\n"+
+			"-- 2.sql\nselect 'myDir/2.sql'\n\n"+
+			"-- 3.sql\nselect 'myDir/3.sql'\n\n"+
+			"-- 3 pending migration(s), 0 already applied\n", out.String())
+	})
+}
+
+func TestHasDirective(t *testing.T) {
+	require.True(t, hasDirective("-- litemigrate:no-transaction\nCREATE INDEX CONCURRENTLY i ON t (c);", directiveNoTransaction))
+	require.True(t, hasDirective("\n-- creates an index\n  -- LiteMigrate:No-Transaction  \nCREATE INDEX CONCURRENTLY i ON t (c);", directiveNoTransaction))
+	require.False(t, hasDirective("CREATE INDEX CONCURRENTLY i ON t (c);\n-- litemigrate:no-transaction", directiveNoTransaction))
+	require.False(t, hasDirective("-- litemigrate:no-transactions\nSELECT 1", directiveNoTransaction))
+}
+
+func TestBeginsTransaction(t *testing.T) {
+	require.True(t, beginsTransaction("BEGIN;\nCREATE TABLE foo (id int);\nCOMMIT;"))
+	require.True(t, beginsTransaction("-- adds foo\n/* see\n#123 */\n  begin transaction isolation level serializable;"))
+	require.True(t, beginsTransaction("START  TRANSACTION;\nCREATE TABLE foo (id int);\nCOMMIT;"))
+	require.False(t, beginsTransaction("CREATE TABLE foo (id int);"))
+	require.False(t, beginsTransaction("-- BEGIN;\nCREATE TABLE foo (id int);"))
+	require.False(t, beginsTransaction("DO $$ BEGIN PERFORM 1; END $$;"))
+	require.False(t, beginsTransaction("begin_date_check();"))
+	require.False(t, beginsTransaction("/* a */ CREATE TABLE foo (id int); /* b */ BEGIN;"))
+	require.False(t, beginsTransaction("-- only a comment"))
+}
+
+func TestService_UpLocking(t *testing.T) {
+	myErr := errors.New("my error")
+
+	t.Run("holds the lock while running migrations", func(t *testing.T) {
+		locked := false
+		store := &storeMock{
+			LockFunc:   func() error { locked = true; return nil },
+			UnlockFunc: func() error { locked = false; return nil },
+			EnsureMigrationTableExistsFunc: func() error {
+				require.True(t, locked)
+				return nil
+			},
+			GetLatestFailedMigrationFunc: func() (*model.Migration, error) { return nil, nil },
+			GetMigrationsFunc:            func() ([]model.Migration, error) { return nil, nil },
+		}
+		fsUtils := &fsUtilsMock{
+			GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) { return nil, nil },
+		}
+
+		s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils}
+		require.NoError(t, s.Up())
+		require.False(t, locked)
+		require.Equal(t, uint(1), store.lockCalls)
+		require.Equal(t, uint(1), store.unlockCalls)
+	})
+
+	t.Run("doesn't run anything when the lock can't be acquired", func(t *testing.T) {
+		store := &storeMock{LockFunc: func() error { return myErr }}
+
+		s := &Service{logger: zap.NewNop(), store: store}
+		require.ErrorIs(t, s.Up(), myErr)
+		require.Zero(t, store.ensureMigrationTableExistsCalls)
+		require.Zero(t, store.unlockCalls)
+	})
+
+	t.Run("releases the lock when migrations fail", func(t *testing.T) {
+		store := &storeMock{EnsureMigrationTableExistsFunc: func() error { return myErr }}
+
+		s := &Service{logger: zap.NewNop(), store: store}
+		require.ErrorIs(t, s.Up(), myErr)
+		require.Equal(t, uint(1), store.unlockCalls)
+	})
+}
+
+func TestService_ensureNoChecksumDrift(t *testing.T) {
+	completedAt := time.Now()
+	fsUtils := &fsUtilsMock{
+		ReadFileContentFunc: func(pathToFile string) (string, error) { return "select '" + pathToFile + "'", nil },
+	}
+
+	t.Run("fails naming every modified file", func(t *testing.T) {
+		store := &storeMock{
+			GetMigrationsFunc: func() ([]model.Migration, error) {
+				return []model.Migration{
+					{ID: 1, Filename: "1.sql", CompletedAt: &completedAt, Checksum: checksum("select 'myDir/1.sql'")},
+					{ID: 2, Filename: "2.sql", CompletedAt: &completedAt, Checksum: "outdated"},
+					{ID: 3, Filename: "3.sql", CompletedAt: &completedAt, Checksum: "outdated"},
+					{ID: 4, Filename: "4.sql", Checksum: "dirty ones are handled elsewhere"},
+				}, nil
+			},
+		}
+
+		s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+		err := s.ensureNoChecksumDrift(context.Background(), true)
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+		require.ErrorContains(t, err, "2.sql")
+		require.ErrorContains(t, err, "3.sql")
+		require.NotContains(t, err.Error(), "1.sql")
+		require.NotContains(t, err.Error(), "4.sql")
+		require.Zero(t, store.updateChecksumCalls)
+	})
+
+	t.Run("records missing checksums only when asked to", func(t *testing.T) {
+		var recorded []string
+		store := &storeMock{
+			GetMigrationsFunc: func() ([]model.Migration, error) {
+				return []model.Migration{{ID: 1, Filename: "1.sql", CompletedAt: &completedAt}}, nil
+			},
+			UpdateChecksumFunc: func(id uint, checksum string) error {
+				recorded = append(recorded, checksum)
+				return nil
+			},
+		}
+
+		s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+		require.NoError(t, s.ensureNoChecksumDrift(context.Background(), false))
+		require.Empty(t, recorded)
+		require.NoError(t, s.ensureNoChecksumDrift(context.Background(), true))
+		require.Equal(t, []string{checksum("select 'myDir/1.sql'")}, recorded)
+	})
+}
+
+func TestService_AcceptChecksum(t *testing.T) {
+	var updated uint
+	store := &storeMock{
+		EnsureMigrationTableExistsFunc: func() error { return nil },
+		GetMigrationsFunc: func() ([]model.Migration, error) {
+			return []model.Migration{{ID: 7, Filename: "1.sql", Checksum: "outdated"}}, nil
+		},
+		UpdateChecksumFunc: func(id uint, sum string) error {
+			require.Equal(t, checksum("select 2"), sum)
+			updated = id
+			return nil
+		},
+	}
+	fsUtils := &fsUtilsMock{ReadFileContentFunc: func(pathToFile string) (string, error) { return "select 2", nil }}
+
+	s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+	require.NoError(t, s.AcceptChecksum("1.sql"))
+	require.Equal(t, uint(7), updated)
+	require.ErrorIs(t, s.AcceptChecksum("2.sql"), ErrMigrationNotFound)
+}
+
+func TestService_UpWithFS(t *testing.T) {
+	var executed []string
+	store := newUpStoreMock()
+	store.RawExecFunc = func(rawSQL string) error {
+		executed = append(executed, rawSQL)
+		return nil
+	}
+	fsys := fstest.MapFS{
+		"migrations/002_bar.sql": {Data: []byte("select 2")},
+		"migrations/001_foo.sql": {Data: []byte("select 1")},
+	}
+
+	s := New(zap.NewNop(), store, "file://./migrations", false, WithFS(fsys))
+	require.NoError(t, s.Up())
+	require.Equal(t, []string{"select 1", "select 2"}, executed)
+}
+
+func TestService_UpContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var executed []string
+	store := newUpStoreMock()
+	store.RawExecFunc = func(rawSQL string) error {
+		executed = append(executed, rawSQL)
+		cancel() // e.g. the application is shutting down while the first migration runs
+		return nil
+	}
+	fsUtils := &fsUtilsMock{
+		GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return []os.DirEntry{fakeDirElement{name: "001_foo.sql"}, fakeDirElement{name: "002_bar.sql"}}, nil
+		},
+		ReadFileContentFunc: func(pathToFile string) (string, error) { return pathToFile, nil },
+	}
+
+	s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+	err := s.UpContext(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, []string{"myDir/001_foo.sql"}, executed)
+	require.Equal(t, uint(1), store.unlockCalls)
+}
+
+func TestService_Baseline(t *testing.T) {
+	files := []os.DirEntry{
+		fakeDirElement{name: "001_foo.sql"},
+		fakeDirElement{name: "002_bar.sql"},
+		fakeDirElement{name: "003_baz.sql"},
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		applied []string
+		want    []string
+		wantErr error
+	}{
+		{name: "records files up to the target", target: "2", want: []string{"001_foo.sql", "002_bar.sql"}},
+		{name: "skips applied files", target: "003_baz.sql", applied: []string{"001_foo.sql"}, want: []string{"002_bar.sql", "003_baz.sql"}},
+		{name: "returns error for unknown target", target: "4", wantErr: ErrTargetNotFound},
+		{name: "returns error for empty target", target: "", wantErr: ErrTargetNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inserted []string
+			var completed []uint
+			store := newUpStoreMock()
+			store.GetMigrationsFunc = func() ([]model.Migration, error) {
+				var applied []model.Migration
+				for _, filename := range tt.applied {
+					applied = append(applied, model.Migration{Filename: filename, Checksum: checksum("select 1")})
+				}
+				return applied, nil
+			}
+			store.InsertMigrationFunc = func(filename, checksum string) (model.Migration, error) {
+				inserted = append(inserted, filename)
+				return model.Migration{ID: uint(len(inserted))}, nil
+			}
+			store.MarkMigrationCompletedFunc = func(id uint) (model.Migration, error) {
+				completed = append(completed, id)
+				return model.Migration{ID: id}, nil
+			}
+			fsUtils := &fsUtilsMock{
+				GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) { return files, nil },
+				ReadFileContentFunc:      func(pathToFile string) (string, error) { return "select 1", nil },
+			}
+
+			s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+			got, err := s.Baseline(tt.target)
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.want, inserted)
+			require.Len(t, completed, len(tt.want))
+			require.Equal(t, uint(0), store.rawExecCalls)
+		})
+	}
+}
+
+func TestService_UpOutOfOrder(t *testing.T) {
+	files := []os.DirEntry{
+		fakeDirElement{name: "001_foo.sql"},
+		fakeDirElement{name: "002_late_branch.sql"},
+		fakeDirElement{name: "003_bar.sql"},
+		fakeDirElement{name: "004_baz.sql"},
+	}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		want    []string
+		wantErr error
+	}{
+		{name: "fails without running anything by default", wantErr: ErrOutOfOrderMigration},
+		{name: "applies gap migrations when allowed", opts: []Option{WithAllowOutOfOrder()}, want: []string{"002_late_branch.sql", "004_baz.sql"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inserted []string
+			store := newUpStoreMock()
+			store.GetMigrationsFunc = func() ([]model.Migration, error) {
+				return []model.Migration{
+					{ID: 1, Filename: "001_foo.sql", Checksum: checksum("select 1")},
+					{ID: 2, Filename: "003_bar.sql", Checksum: checksum("select 1")},
+				}, nil
+			}
+			store.InsertMigrationFunc = func(filename, checksum string) (model.Migration, error) {
+				inserted = append(inserted, filename)
+				return model.Migration{}, nil
+			}
+			fsUtils := &fsUtilsMock{
+				GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) { return files, nil },
+				ReadFileContentFunc:      func(pathToFile string) (string, error) { return "select 1", nil },
+			}
+
+			s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+			for _, opt := range tt.opts {
+				opt(s)
+			}
+			err := s.Up()
+			require.ErrorIs(t, err, tt.wantErr)
+			if tt.wantErr != nil {
+				require.ErrorContains(t, err, "002_late_branch.sql")
+			}
+			require.Equal(t, tt.want, inserted)
+		})
+	}
+}
+
+func TestService_UpWithGoMigrations(t *testing.T) {
+	var executed []string
+	store := newUpStoreMock()
+	store.InsertMigrationFunc = func(filename, checksum string) (model.Migration, error) {
+		if filename == "002_backfill" {
+			require.Empty(t, checksum)
+		}
+		return model.Migration{}, nil
+	}
+	store.RawExecFunc = func(rawSQL string) error {
+		executed = append(executed, rawSQL)
+		return nil
+	}
+	fsUtils := &fsUtilsMock{
+		GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return fsutils.DirElements{fakeDirElement{name: "001_foo.sql"}, fakeDirElement{name: "10_bar.sql"}}, nil
+		},
+		ReadFileContentFunc: func(pathToFile string) (string, error) { return pathToFile, nil },
+	}
+
+	s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir",
+		goMigrations: map[string]GoMigrationFunc{
+			"002_backfill": func(ctx context.Context, tx *sql.Tx) error {
+				executed = append(executed, "002_backfill")
+				return nil
+			},
+		},
+	}
+	require.NoError(t, s.Up())
+	require.Equal(t, []string{"myDir/001_foo.sql", "002_backfill", "myDir/10_bar.sql"}, executed)
+	require.Equal(t, uint(3), store.execTxCalls)
+
+	s.goMigrations["10_conflict"] = func(ctx context.Context, tx *sql.Tx) error { return nil }
+	require.ErrorIs(t, s.Up(), ErrDuplicateVersion)
+}
+
+func TestRegister(t *testing.T) {
+	fn := func(ctx context.Context, tx *sql.Tx) error { return nil }
+
+	Register("9999_test_register", fn)
+	t.Cleanup(func() { delete(registry, "9999_test_register") })
+	require.Contains(t, registered(), "9999_test_register")
+
+	require.Panics(t, func() { Register("9999_test_register", fn) })
+	require.Panics(t, func() { Register("no_version", fn) })
+	require.Panics(t, func() { Register("9998_nil", nil) })
+}
+
+func TestService_UpWithTemplateVars(t *testing.T) {
+	templated := "CREATE SCHEMA {{.schema}};"
+	arrayLiteral := "INSERT INTO matrix VALUES ('{{1,2},{3,4}}');"
+
+	tests := []struct {
+		name    string
+		source  string
+		vars    map[string]string
+		want    []string
+		wantErr error
+	}{
+		{name: "renders files with the variables", source: templated, vars: map[string]string{"schema": "tenant_a"}, want: []string{"CREATE SCHEMA tenant_a;"}},
+		{name: "fails for undefined variables without running anything", source: templated, vars: map[string]string{"other": "x"}, wantErr: ErrTemplateRender},
+		{name: "fails for variables if none are set", source: templated, wantErr: ErrTemplateRender},
+		{name: "leaves files that aren't templates untouched without variables", source: arrayLiteral, want: []string{arrayLiteral}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := tt.source
+			var executed []string
+			store := newUpStoreMock()
+			store.InsertMigrationFunc = func(filename, sum string) (model.Migration, error) {
+				require.Equal(t, checksum(source), sum) // taken before rendering
+				return model.Migration{}, nil
+			}
+			store.RawExecFunc = func(rawSQL string) error {
+				executed = append(executed, rawSQL)
+				return nil
+			}
+			fsUtils := &fsUtilsMock{
+				GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+					return fsutils.DirElements{fakeDirElement{name: "001_schema.sql"}}, nil
+				},
+				ReadFileContentFunc: func(pathToFile string) (string, error) { return source, nil },
+			}
+
+			s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+			if tt.vars != nil {
+				WithTemplateVars(tt.vars)(s)
+			}
+			require.ErrorIs(t, s.Validate(), tt.wantErr)
+			err := s.Up()
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.want, executed)
+		})
+	}
+}
+
+func TestService_UpWithStatementSplitting(t *testing.T) {
+	source := "CREATE TABLE vets (name text);\n\nINSERT INTO vets\n  VALUES (nope);\nSELECT 1;"
+	pgErr := &pgconn.PgError{Severity: "ERROR", Code: "42703", Message: `column "nope" does not exist`, Position: 28}
+
+	tests := []struct {
+		name      string
+		source    string
+		split     bool
+		execErr   error
+		want      []string
+		wantError string
+	}{
+		{
+			name:   "runs the file as a whole by default",
+			source: source,
+			want:   []string{source},
+		},
+		{
+			name:   "runs statements one at a time",
+			source: source,
+			split:  true,
+			want:   []string{"CREATE TABLE vets (name text)", "INSERT INTO vets\n  VALUES (nope)", "SELECT 1"},
+		},
+		{
+			name:      "reports the position of the failing statement",
+			source:    source,
+			split:     true,
+			execErr:   errors.New("boom"),
+			want:      []string{"CREATE TABLE vets (name text)", "INSERT INTO vets\n  VALUES (nope)"},
+			wantError: "statement 2 at 001_vets.sql:3:1: boom",
+		},
+		{
+			name:      "reports the position postgres points to",
+			source:    source,
+			split:     true,
+			execErr:   pgErr,
+			want:      []string{"CREATE TABLE vets (name text)", "INSERT INTO vets\n  VALUES (nope)"},
+			wantError: "statement 2 at 001_vets.sql:4:11: " + pgErr.Error(),
+		},
+		{
+			name:   "runs files with the no-split directive as a whole",
+			source: "-- litemigrate:no-split\n" + source,
+			split:  true,
+			want:   []string{"-- litemigrate:no-split\n" + source},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var executed []string
+			store := newUpStoreMock()
+			store.RawExecFunc = func(rawSQL string) error {
+				executed = append(executed, rawSQL)
+				if strings.Contains(rawSQL, "nope") {
+					return tt.execErr
+				}
+				return nil
+			}
+			fsUtils := &fsUtilsMock{
+				GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+					return fsutils.DirElements{fakeDirElement{name: "001_vets.sql"}}, nil
+				},
+				ReadFileContentFunc: func(pathToFile string) (string, error) { return tt.source, nil },
+			}
+
+			s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+			if tt.split {
+				WithStatementSplitting()(s)
+			}
+			err := s.Up()
+			require.Equal(t, tt.want, executed)
+			if tt.wantError == "" {
+				require.NoError(t, err)
+				return
+			}
+			var statementErr *StatementError
+			require.ErrorAs(t, err, &statementErr)
+			require.Equal(t, 2, statementErr.Index)
+			require.ErrorIs(t, err, tt.execErr)
+			require.Equal(t, tt.wantError, statementErr.Error())
+		})
+	}
+}
+
+func TestService_UpWithCallbacks(t *testing.T) {
+	files := map[string]string{
+		"001_foo.sql":    "CREATE TABLE foo (id int);",
+		"002_bar.sql":    "CREATE TABLE bar (id int);",
+		"beforeAll.sql":  "SET search_path TO {{.schema}};",
+		"beforeEach.sql": "SET lock_timeout = '5s';",
+		"afterEach.sql":  "ANALYZE;",
+		"afterAll.sql":   "GRANT SELECT ON ALL TABLES IN SCHEMA {{.schema}} TO reader;",
+	}
+
+	tests := []struct {
+		name      string
+		applied   []string
+		failOn    string
+		callbacks []string
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "runs callbacks around migrations",
+			callbacks: []string{"beforeAll.sql", "beforeEach.sql", "afterEach.sql", "afterAll.sql"},
+			want: []string{
+				"SET search_path TO app;",
+				"begin", "SET lock_timeout = '5s';", "CREATE TABLE foo (id int);", "ANALYZE;", "commit",
+				"begin", "SET lock_timeout = '5s';", "CREATE TABLE bar (id int);", "ANALYZE;", "commit",
+				"GRANT SELECT ON ALL TABLES IN SCHEMA app TO reader;",
+			},
+		},
+		{
+			name:      "runs only existing callbacks",
+			callbacks: []string{"afterAll.sql"},
+			want: []string{
+				"begin", "CREATE TABLE foo (id int);", "commit",
+				"begin", "CREATE TABLE bar (id int);", "commit",
+				"GRANT SELECT ON ALL TABLES IN SCHEMA app TO reader;",
+			},
+		},
+		{
+			name:      "runs no callbacks without pending migrations",
+			applied:   []string{"001_foo.sql", "002_bar.sql"},
+			callbacks: []string{"beforeAll.sql", "beforeEach.sql", "afterEach.sql", "afterAll.sql"},
+		},
+		{
+			name:      "rolls back the migration if afterEach fails and skips afterAll",
+			failOn:    "ANALYZE;",
+			callbacks: []string{"beforeAll.sql", "afterEach.sql", "afterAll.sql"},
+			want:      []string{"SET search_path TO app;", "begin", "CREATE TABLE foo (id int);", "ANALYZE;", "rollback"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var executed []string
+			var applied []model.Migration
+			for _, filename := range tt.applied {
+				applied = append(applied, model.Migration{Filename: filename, Checksum: checksum(files[filename])})
+			}
+			store := newUpStoreMock()
+			store.GetMigrationsFunc = func() ([]model.Migration, error) { return applied, nil }
+			store.ExecTxFunc = func(fn func(ctx context.Context, tx *sql.Tx) error) error {
+				executed = append(executed, "begin")
+				if err := fn(context.Background(), nil); err != nil {
+					executed = append(executed, "rollback")
+					return err
+				}
+				executed = append(executed, "commit")
+				return nil
+			}
+			store.RawExecFunc = func(rawSQL string) error {
+				executed = append(executed, rawSQL)
+				if rawSQL == tt.failOn {
+					return errors.New("boom")
+				}
+				return nil
+			}
+			fsUtils := &fsUtilsMock{
+				GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+					return fsutils.DirElements{fakeDirElement{name: "001_foo.sql"}, fakeDirElement{name: "002_bar.sql"}}, nil
+				},
+				GetCallbackFileListFunc: func(dir string) (fsutils.DirElements, error) {
+					result := fsutils.DirElements{}
+					for _, name := range tt.callbacks {
+						result = append(result, fakeDirElement{name: name})
+					}
+					return result, nil
+				},
+				ReadFileContentFunc: func(pathToFile string) (string, error) {
+					return files[strings.TrimPrefix(pathToFile, "myDir/")], nil
+				},
+			}
+
+			s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+			WithTemplateVars(map[string]string{"schema": "app"})(s)
+			err := s.Up()
+			if tt.wantErr {
+				require.ErrorContains(t, err, "callback afterEach.sql failed")
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.want, executed)
+		})
+	}
+}
+
+func TestService_UpWithRepeatables(t *testing.T) {
+	files := map[string]string{
+		"001_foo.sql":      "CREATE TABLE foo (id int);",
+		"R__new.sql":       "CREATE OR REPLACE VIEW new AS SELECT 1;",
+		"R__unchanged.sql": "CREATE OR REPLACE VIEW unchanged AS SELECT 1;",
+		"R__changed.sql":   "CREATE OR REPLACE VIEW changed AS SELECT 2;",
+	}
+	completedAt := time.Now()
+	applied := []model.Migration{
+		{ID: 1, Filename: "R__unchanged.sql", Checksum: checksum(files["R__unchanged.sql"]), CompletedAt: &completedAt},
+		{ID: 2, Filename: "R__changed.sql", Checksum: checksum("CREATE OR REPLACE VIEW changed AS SELECT 1;"), CompletedAt: &completedAt},
+	}
+
+	var executed, inserted []string
+	updated := map[uint]string{}
+	store := newUpStoreMock()
+	store.GetMigrationsFunc = func() ([]model.Migration, error) { return applied, nil }
+	store.InsertMigrationFunc = func(filename, sum string) (model.Migration, error) {
+		inserted = append(inserted, filename)
+		return model.Migration{Filename: filename}, nil
+	}
+	store.UpdateChecksumFunc = func(id uint, sum string) error {
+		updated[id] = sum
+		return nil
+	}
+	store.MarkMigrationCompletedFunc = func(id uint) (model.Migration, error) { return model.Migration{ID: id}, nil }
+	store.RawExecFunc = func(rawSQL string) error {
+		executed = append(executed, rawSQL)
+		return nil
+	}
+	fsUtils := &fsUtilsMock{
+		GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return fsutils.DirElements{fakeDirElement{name: "001_foo.sql"}}, nil
+		},
+		GetRepeatableFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return fsutils.DirElements{
+				fakeDirElement{name: "R__changed.sql"}, fakeDirElement{name: "R__new.sql"}, fakeDirElement{name: "R__unchanged.sql"},
+			}, nil
+		},
+		ReadFileContentFunc: func(pathToFile string) (string, error) {
+			return files[strings.TrimPrefix(pathToFile, "myDir/")], nil
+		},
+	}
+	s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir"}
+
+	plan, err := s.Plan()
+	require.NoError(t, err)
+	require.Len(t, plan.Migrations, 1)
+	require.Len(t, plan.Repeatable, 2)
+
+	// repeatable migrations are left out when migrating up to a target
+	plan, err = s.PlanUpTo("001_foo.sql")
+	require.NoError(t, err)
+	require.Len(t, plan.Migrations, 1)
+	require.Empty(t, plan.Repeatable)
+
+	report, err := s.Status()
+	require.NoError(t, err)
+	states := map[string]MigrationState{}
+	for _, migration := range report.Migrations {
+		states[migration.Filename] = migration.State
+	}
+	require.Equal(t, map[string]MigrationState{
+		"001_foo.sql":      StatePending,
+		"R__changed.sql":   StatePending,
+		"R__new.sql":       StatePending,
+		"R__unchanged.sql": StateApplied,
+	}, states)
+
+	require.NoError(t, s.Up())
+	require.Equal(t, []string{files["001_foo.sql"], files["R__changed.sql"], files["R__new.sql"]}, executed)
+	require.Equal(t, []string{"001_foo.sql", "R__new.sql"}, inserted)
+	require.Equal(t, map[uint]string{2: checksum(files["R__changed.sql"])}, updated)
+
+	// repeatable migrations can't be rolled back
+	require.ErrorIs(t, s.Redo(), ErrNoMigrationsApplied)
+}
+
+func TestService_UpWithMetrics(t *testing.T) {
+	myErr := errors.New("my error")
+	completedAt := time.Now()
+	applied := []model.Migration{
+		{ID: 1, Filename: "001_foo.sql", Checksum: checksum("SELECT 1;"), CompletedAt: &completedAt},
+		{ID: 2, Filename: "R__views.sql", CompletedAt: &completedAt},
+	}
+
+	store := newUpStoreMock()
+	store.GetMigrationsFunc = func() ([]model.Migration, error) { return applied, nil }
+	store.InsertMigrationFunc = func(filename, sum string) (model.Migration, error) {
+		return model.Migration{ID: uint(len(applied) + 1), Filename: filename}, nil
+	}
+	store.MarkMigrationCompletedFunc = func(id uint) (model.Migration, error) {
+		migration := model.Migration{ID: id, Filename: "002_bar.sql", CompletedAt: &completedAt}
+		applied = append(applied, migration)
+		return migration, nil
+	}
+	store.RawExecFunc = func(rawSQL string) error {
+		if strings.HasSuffix(rawSQL, "broken") {
+			applied = append(applied, model.Migration{ID: uint(len(applied) + 1), Filename: "003_baz.sql"})
+			return myErr
+		}
+		return nil
+	}
+	fsUtils := &fsUtilsMock{
+		GetMigrationFileListFunc: func(dir string) (fsutils.DirElements, error) {
+			return fsutils.DirElements{
+				fakeDirElement{name: "001_foo.sql"}, fakeDirElement{name: "002_bar.sql"}, fakeDirElement{name: "003_baz.sql"},
+			}, nil
+		},
+		ReadFileContentFunc: func(pathToFile string) (string, error) {
+			if pathToFile == "myDir/003_baz.sql" {
+				return "-- litemigrate:no-transaction\nbroken", nil
+			}
+			return "SELECT 1;", nil
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	metrics, err := NewMetrics(registry)
+	require.NoError(t, err)
+	_, err = NewMetrics(registry)
+	require.Error(t, err, "metrics can only be registered once")
+
+	s := &Service{logger: zap.NewNop(), store: store, fsUtils: fsUtils, migrationPath: "myDir", metrics: metrics}
+	require.ErrorIs(t, s.Up(), myErr)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.applied))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.skipped))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.failed))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.dirty))
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.version))
+	require.Equal(t, 1, testutil.CollectAndCount(registry, "litemigrate_migration_duration_seconds"))
+
+	// the dirty migration keeps Up from running anything, but the gauges are still up to date
+	store.GetLatestFailedMigrationFunc = func() (*model.Migration, error) { return &applied[len(applied)-1], nil }
+	require.ErrorIs(t, s.Up(), ErrDirtyMigrationExists)
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.applied))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.dirty))
+}
+
+func TestRunTenants(t *testing.T) {
+	myErr := errors.New("my error")
+	tenants := []string{"tenant_a", "tenant_b", "tenant_c", "tenant_d", "tenant_e"}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	results := RunTenants(context.Background(), tenants, 2, func(ctx context.Context, tenant string) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if tenant == "tenant_b" {
+			return myErr
+		}
+		return nil
+	})
+
+	require.Equal(t, 2, maxRunning)
+	require.Len(t, results, len(tenants))
+	for i, result := range results {
+		require.Equal(t, tenants[i], result.Tenant)
+		require.NotZero(t, result.Duration)
+	}
+	require.ErrorIs(t, results[1].Err, myErr)
+	require.Equal(t, 1, results.Failed())
+	require.ErrorIs(t, results.Err(), ErrTenantsFailed)
+
+	// tenants aren't started once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = RunTenants(ctx, tenants, 2, func(ctx context.Context, tenant string) error {
+		t.Fatalf("tenant %s must not run", tenant)
+		return nil
+	})
+	require.Equal(t, len(tenants), results.Failed())
+	require.ErrorIs(t, results[0].Err, context.Canceled)
+
+	require.NoError(t, RunTenants(context.Background(), tenants, 0, func(context.Context, string) error { return nil }).Err())
+}
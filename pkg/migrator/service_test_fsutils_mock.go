@@ -7,11 +7,17 @@ import (
 )
 
 type fsUtilsMock struct {
-	getMigrationFileListCalls uint
-	readFileContentCalls      uint
+	getMigrationFileListCalls  uint
+	getCallbackFileListCalls   uint
+	getRepeatableFileListCalls uint
+	readFileContentCalls       uint
+	createFileCalls            uint
 
-	GetMigrationFileListFunc func(dir string) (fsutils.DirElements, error)
-	ReadFileContentFunc      func(pathToFile string) (string, error)
+	GetMigrationFileListFunc  func(dir string) (fsutils.DirElements, error)
+	GetCallbackFileListFunc   func(dir string) (fsutils.DirElements, error) // optional, no callbacks if nil
+	GetRepeatableFileListFunc func(dir string) (fsutils.DirElements, error) // optional, no repeatable migrations if nil
+	ReadFileContentFunc       func(pathToFile string) (string, error)
+	CreateFileFunc            func(pathToFile, content string) error
 }
 
 func (f *fsUtilsMock) GetMigrationFileList(dir string) (fsutils.DirElements, error) {
@@ -19,11 +25,32 @@ func (f *fsUtilsMock) GetMigrationFileList(dir string) (fsutils.DirElements, err
 	return f.GetMigrationFileListFunc(dir)
 }
 
+func (f *fsUtilsMock) GetCallbackFileList(dir string) (fsutils.DirElements, error) {
+	f.getCallbackFileListCalls++
+	if f.GetCallbackFileListFunc == nil {
+		return nil, nil
+	}
+	return f.GetCallbackFileListFunc(dir)
+}
+
+func (f *fsUtilsMock) GetRepeatableFileList(dir string) (fsutils.DirElements, error) {
+	f.getRepeatableFileListCalls++
+	if f.GetRepeatableFileListFunc == nil {
+		return nil, nil
+	}
+	return f.GetRepeatableFileListFunc(dir)
+}
+
 func (f *fsUtilsMock) ReadFileContent(pathToFile string) (string, error) {
 	f.readFileContentCalls++
 	return f.ReadFileContentFunc(pathToFile)
 }
 
+func (f *fsUtilsMock) CreateFile(pathToFile, content string) error {
+	f.createFileCalls++
+	return f.CreateFileFunc(pathToFile, content)
+}
+
 // fakeDirElement is a mock implementation of os.DirEntry (which in turn is an alias for fs.DirEntry)
 type fakeDirElement struct {
 	name  string
@@ -1,6 +1,9 @@
 package migrator
 
 import (
+	"context"
+	"database/sql"
+
 	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/model"
 )
 
@@ -9,47 +12,147 @@ type storeMock struct {
 	insertMigrationCalls            uint
 	rawExecCalls                    uint
 	markMigrationCompletedCalls     uint
+	markMigrationForcedCalls        uint
+	markMigrationForRetryCalls      uint
+	restartMigrationCalls           uint
+	updateChecksumCalls             uint
 	ensureMigrationTableExistsCalls uint
+	migrationTableExistsCalls       uint
 	getLatestFailedMigrationCalls   uint
+	getMigrationsCalls              uint
+	deleteMigrationCalls            uint
+	execTxCalls                     uint
+	lockCalls                       uint
+	unlockCalls                     uint
 
 	HasMigrationRunFunc            func(filename string) (bool, error)
-	InsertMigrationFunc            func(filename string) (model.Migration, error)
+	InsertMigrationFunc            func(filename, checksum string) (model.Migration, error)
 	RawExecFunc                    func(rawSql string) error
 	MarkMigrationCompletedFunc     func(id uint) (model.Migration, error)
+	MarkMigrationForcedFunc        func(id uint, forcedBy string) (model.Migration, error)
+	MarkMigrationForRetryFunc      func(id uint, forcedBy string) (model.Migration, error)
+	UpdateChecksumFunc             func(id uint, checksum string) error
 	EnsureMigrationTableExistsFunc func() error
 	GetLatestFailedMigrationFunc   func() (*model.Migration, error)
+	GetMigrationsFunc              func() ([]model.Migration, error)
+	DeleteMigrationFunc            func(id uint) error
+	// the restart, lock and transaction funcs are optional, they succeed if they aren't set. Without ExecTxFunc, fn
+	// is run with a nil transaction. The migrations table exists unless MigrationTableExistsFunc says otherwise.
+	RestartMigrationFunc     func(id uint) error
+	MigrationTableExistsFunc func() (bool, error)
+	LockFunc                 func() error
+	UnlockFunc               func() error
+	ExecTxFunc               func(fn func(ctx context.Context, tx *sql.Tx) error) error
+}
+
+// newUpStoreMock returns a storeMock that Up() can run against: the migrations table is empty, and inserting, running
+// and completing a migration succeed without doing anything. Tests override the funcs they check.
+func newUpStoreMock() *storeMock {
+	return &storeMock{
+		EnsureMigrationTableExistsFunc: func() error { return nil },
+		GetLatestFailedMigrationFunc:   func() (*model.Migration, error) { return nil, nil },
+		GetMigrationsFunc:              func() ([]model.Migration, error) { return nil, nil },
+		InsertMigrationFunc:            func(filename, checksum string) (model.Migration, error) { return model.Migration{}, nil },
+		MarkMigrationCompletedFunc:     func(id uint) (model.Migration, error) { return model.Migration{}, nil },
+		RawExecFunc:                    func(rawSQL string) error { return nil },
+	}
 }
 
 func (s *storeMock) Close() error {
 	return nil
 }
 
-func (s *storeMock) HasMigrationRun(filename string) (bool, error) {
+func (s *storeMock) HasMigrationRunContext(_ context.Context, filename string) (bool, error) {
 	s.hasMigrationRunCalls++
 	return s.HasMigrationRunFunc(filename)
 }
 
-func (s *storeMock) InsertMigration(filename string) (model.Migration, error) {
+func (s *storeMock) InsertMigrationContext(_ context.Context, filename, checksum string) (model.Migration, error) {
 	s.insertMigrationCalls++
-	return s.InsertMigrationFunc(filename)
+	return s.InsertMigrationFunc(filename, checksum)
 }
 
-func (s *storeMock) RawExec(rawSQL string) error {
+func (s *storeMock) RawExecContext(_ context.Context, rawSQL string) error {
 	s.rawExecCalls++
 	return s.RawExecFunc(rawSQL)
 }
 
-func (s *storeMock) MarkMigrationCompleted(id uint) (model.Migration, error) {
+func (s *storeMock) MarkMigrationCompletedContext(_ context.Context, id uint) (model.Migration, error) {
 	s.markMigrationCompletedCalls++
 	return s.MarkMigrationCompletedFunc(id)
 }
 
-func (s *storeMock) EnsureMigrationTableExists() error {
+func (s *storeMock) MarkMigrationForcedContext(_ context.Context, id uint, forcedBy string) (model.Migration, error) {
+	s.markMigrationForcedCalls++
+	return s.MarkMigrationForcedFunc(id, forcedBy)
+}
+
+func (s *storeMock) MarkMigrationForRetryContext(_ context.Context, id uint, forcedBy string) (model.Migration, error) {
+	s.markMigrationForRetryCalls++
+	return s.MarkMigrationForRetryFunc(id, forcedBy)
+}
+
+func (s *storeMock) RestartMigrationContext(_ context.Context, id uint) error {
+	s.restartMigrationCalls++
+	if s.RestartMigrationFunc == nil {
+		return nil
+	}
+	return s.RestartMigrationFunc(id)
+}
+
+func (s *storeMock) UpdateChecksumContext(_ context.Context, id uint, checksum string) error {
+	s.updateChecksumCalls++
+	return s.UpdateChecksumFunc(id, checksum)
+}
+
+func (s *storeMock) EnsureMigrationTableExistsContext(_ context.Context) error {
 	s.ensureMigrationTableExistsCalls++
 	return s.EnsureMigrationTableExistsFunc()
 }
 
-func (s *storeMock) GetLatestFailedMigration() (*model.Migration, error) {
+func (s *storeMock) MigrationTableExistsContext(_ context.Context) (bool, error) {
+	s.migrationTableExistsCalls++
+	if s.MigrationTableExistsFunc == nil {
+		return true, nil
+	}
+	return s.MigrationTableExistsFunc()
+}
+
+func (s *storeMock) GetLatestFailedMigrationContext(_ context.Context) (*model.Migration, error) {
 	s.getLatestFailedMigrationCalls++
 	return s.GetLatestFailedMigrationFunc()
 }
+
+func (s *storeMock) GetMigrationsContext(_ context.Context) ([]model.Migration, error) {
+	s.getMigrationsCalls++
+	return s.GetMigrationsFunc()
+}
+
+func (s *storeMock) DeleteMigrationContext(_ context.Context, id uint) error {
+	s.deleteMigrationCalls++
+	return s.DeleteMigrationFunc(id)
+}
+
+func (s *storeMock) ExecTxContext(ctx context.Context, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	s.execTxCalls++
+	if s.ExecTxFunc == nil {
+		return fn(ctx, nil)
+	}
+	return s.ExecTxFunc(fn)
+}
+
+func (s *storeMock) LockContext(_ context.Context) error {
+	s.lockCalls++
+	if s.LockFunc == nil {
+		return nil
+	}
+	return s.LockFunc()
+}
+
+func (s *storeMock) Unlock() error {
+	s.unlockCalls++
+	if s.UnlockFunc == nil {
+		return nil
+	}
+	return s.UnlockFunc()
+}
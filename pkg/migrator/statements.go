@@ -0,0 +1,62 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+	"github.com/ymakhloufi/litemigrate/internal/pkg/sqlsplit"
+)
+
+// directiveNoSplit makes a migration run as a single string even if statement splitting is enabled, e.g. because it
+// contains syntax the splitter doesn't understand
+const directiveNoSplit = "no-split"
+
+// WithStatementSplitting makes the service split migration files into single statements and execute them one at a
+// time, so that a failing statement is reported with its position in the file, see StatementError. The splitter
+// understands Postgres syntax, i.e. comments, string literals, quoted identifiers and dollar-quoted strings.
+func WithStatementSplitting() Option {
+	return func(s *Service) {
+		s.splitStatements = true
+	}
+}
+
+// StatementError is returned if a single statement of a migration file fails, see WithStatementSplitting
+type StatementError struct {
+	Filename string
+	// Index is the 1-based index of the statement within the file
+	Index int
+	// Line and Column are the 1-based position of the error within the file. They point to the start of the statement
+	// unless the database reported a more precise position.
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("statement %d at %s:%d:%d: %s", e.Index, e.Filename, e.Line, e.Column, e.Err)
+}
+
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
+// execSQL executes the migration file, statement by statement if statement splitting is enabled
+func (s *Service) execSQL(ctx context.Context, filename, rawSQL string) error {
+	if !s.splitStatements || hasDirective(rawSQL, directiveNoSplit) {
+		return s.store.RawExecContext(ctx, rawSQL)
+	}
+
+	for i, statement := range sqlsplit.Split(rawSQL) {
+		if err := s.store.RawExecContext(ctx, statement.SQL); err != nil {
+			statementErr := &StatementError{Filename: filename, Index: i + 1, Line: statement.Line, Column: statement.Column, Err: err}
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Position > 0 {
+				statementErr.Line, statementErr.Column = statement.Position(int(pgErr.Position))
+			}
+			return statementErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+type MigrationState string
+
+const (
+	// StateApplied means the migration has run successfully
+	StateApplied MigrationState = "applied"
+	// StatePending means the migration file hasn't been run yet, has been forced to run again, or is a repeatable
+	// migration that has changed since
+	StatePending MigrationState = "pending"
+	// StateDirty means the migration has been started but never completed, see ErrDirtyMigrationExists
+	StateDirty MigrationState = "dirty"
+	// StateOrphaned means the migration is in the migrations table, but its file doesn't exist (anymore)
+	StateOrphaned MigrationState = "orphaned"
+	// StateModified means the migration has been applied, but its file has been modified since, see ErrChecksumMismatch
+	StateModified MigrationState = "modified"
+	// StateOutOfOrder means the migration file hasn't been run yet, but sorts before migrations that have already been
+	// applied, see ErrOutOfOrderMigration
+	StateOutOfOrder MigrationState = "out-of-order"
+)
+
+type MigrationStatus struct {
+	Filename    string         `json:"filename"`
+	State       MigrationState `json:"state"`
+	StartedAt   *time.Time     `json:"started_at,omitempty"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty"`
+	Checksum    string         `json:"checksum,omitempty"`
+	ForcedBy    string         `json:"forced_by,omitempty"`
+	ForcedAt    *time.Time     `json:"forced_at,omitempty"`
+}
+
+type StatusReport struct {
+	Migrations []MigrationStatus `json:"migrations"`
+}
+
+// Count returns the number of migrations in the given state
+func (r StatusReport) Count(state MigrationState) int {
+	count := 0
+	for _, migration := range r.Migrations {
+		if migration.State == state {
+			count++
+		}
+	}
+	return count
+}
+
+// Status merges the migration files with the contents of the migrations table. Files are listed in the order they
+// would run, followed by orphaned migrations in the order they were applied. Repeatable migrations whose files have
+// changed since they were last run are pending again. It doesn't change anything in the database, not even create the
+// migrations table: if it doesn't exist yet, every migration is pending.
+func (s *Service) Status() (StatusReport, error) {
+	return s.StatusContext(context.Background())
+}
+
+// StatusContext is like Status, but stops once ctx is done
+func (s *Service) StatusContext(ctx context.Context) (StatusReport, error) {
+	ro, err := s.readOnly(ctx)
+	if err != nil {
+		return StatusReport{}, err
+	}
+	return ro.status(ctx)
+}
+
+func (s *Service) status(ctx context.Context) (StatusReport, error) {
+	files, err := s.migrationFiles()
+	if err != nil {
+		return StatusReport{}, fmt.Errorf("failed to get migration file list in dir %s: %w", s.migrationPath, err)
+	}
+	repeatables, err := s.fsUtils.GetRepeatableFileList(s.migrationPath)
+	if err != nil {
+		return StatusReport{}, fmt.Errorf("failed to get repeatable migration file list in dir %s: %w", s.migrationPath, err)
+	}
+	migrations, err := s.store.GetMigrationsContext(ctx)
+	if err != nil {
+		return StatusReport{}, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	applied := make(map[string]MigrationStatus, len(migrations))
+	for _, migration := range migrations {
+		startedAt := migration.StartedAt
+		status := MigrationStatus{
+			Filename:    migration.Filename,
+			State:       StateApplied,
+			StartedAt:   &startedAt,
+			CompletedAt: migration.CompletedAt,
+			Checksum:    migration.Checksum,
+			ForcedBy:    migration.ForcedBy,
+			ForcedAt:    migration.ForcedAt,
+		}
+		if migration.IsDirty() {
+			status.State = StateDirty
+		} else if migration.AwaitsRetry() {
+			status.State = StatePending
+		}
+		applied[migration.Filename] = status
+	}
+
+	modified, _, err := s.compareChecksums(migrations)
+	if err != nil {
+		return StatusReport{}, err
+	}
+	for _, drift := range modified {
+		status := applied[drift.migration.Filename]
+		status.State = StateModified
+		applied[drift.migration.Filename] = status
+	}
+
+	lastApplied := -1
+	for i, file := range files {
+		if _, ok := applied[file.Name()]; ok {
+			lastApplied = i
+		}
+	}
+
+	report := StatusReport{Migrations: make([]MigrationStatus, 0, len(files)+len(repeatables)+len(migrations))}
+	onDisk := make(map[string]bool, len(files)+len(repeatables))
+	for i, file := range files {
+		onDisk[file.Name()] = true
+		if status, ok := applied[file.Name()]; ok {
+			report.Migrations = append(report.Migrations, status)
+			continue
+		}
+		state := StatePending
+		if i < lastApplied {
+			state = StateOutOfOrder
+		}
+		report.Migrations = append(report.Migrations, MigrationStatus{Filename: file.Name(), State: state})
+	}
+
+	for _, file := range repeatables {
+		onDisk[file.Name()] = true
+		status, ok := applied[file.Name()]
+		if !ok {
+			report.Migrations = append(report.Migrations, MigrationStatus{Filename: file.Name(), State: StatePending})
+			continue
+		}
+		if status.State == StateApplied {
+			rawSQL, err := s.fsUtils.ReadFileContent(filepath.Join(s.migrationPath, file.Name()))
+			if err != nil {
+				return StatusReport{}, fmt.Errorf("failed to read migration file %s: %w", file.Name(), err)
+			}
+			if checksum(rawSQL) != status.Checksum {
+				status.State = StatePending
+			}
+		}
+		report.Migrations = append(report.Migrations, status)
+	}
+
+	for _, migration := range migrations {
+		if !onDisk[migration.Filename] {
+			status := applied[migration.Filename]
+			status.State = StateOrphaned
+			report.Migrations = append(report.Migrations, status)
+		}
+	}
+
+	return report, nil
+}
@@ -2,19 +2,35 @@ package store
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/go-playground/validator/v10"
+	"github.com/go-sql-driver/mysql"
+	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/store"
 )
 
 type Config struct {
-	Driver string `env:"DRIVER,required"`
+	Driver string `env:"DRIVER"`
 	Host   string `env:"HOST,required"   validate:"required"`
 	Port   uint16 `env:"PORT,required"   validate:"required,min=1,max=65535"`
 	User   string `env:"USER,required"   validate:"required,ascii"`
 	Pass   string `env:"PASS,required"   validate:"required"`
 	DB     string `env:"DB,required"     validate:"required,ascii"`
 	SSL    bool   `env:"SSL"             validate:"boolean"`
+	// Table is the name of the migrations table, Schema the schema it lives in, see WithSchema
+	Table  string `env:"TABLE" envDefault:"_migrations" validate:"identifier"`
+	Schema string `env:"SCHEMA"                         validate:"omitempty,identifier"`
+	// SearchPath are the schemas on the postgres search_path of the connection, e.g. tenant_a and public. They are
+	// quoted, so mixed-case names are kept as they are. The server's default if empty.
+	SearchPath []string
+}
+
+// Validate checks the configuration, e.g. after Table or Schema have been overridden
+func (c Config) Validate() error {
+	return newValidator().Struct(c)
 }
 
 func (c Config) ToConnectionString() string {
@@ -22,8 +38,26 @@ func (c Config) ToConnectionString() string {
 	if c.SSL {
 		sslMode = "enable"
 	}
-	return fmt.Sprintf("%s://%s:%s@%s:%d/%s?sslmode=%s",
+	connectionString := fmt.Sprintf("%s://%s:%s@%s:%d/%s?sslmode=%s",
 		c.Driver, c.User, c.Pass, c.Host, c.Port, c.DB, sslMode)
+	if len(c.SearchPath) > 0 {
+		connectionString += "&search_path=" + url.QueryEscape(store.QuoteSearchPath(c.SearchPath...))
+	}
+	return connectionString
+}
+
+// ToMySQLDSN returns the data source name for the mysql driver
+func (c Config) ToMySQLDSN() string {
+	cfg := mysql.NewConfig()
+	cfg.User = c.User
+	cfg.Passwd = c.Pass
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(c.Host, strconv.Itoa(int(c.Port)))
+	cfg.DBName = c.DB
+	if c.SSL {
+		cfg.TLSConfig = "true"
+	}
+	return cfg.FormatDSN()
 }
 
 // parseEnvIntoStruct parses environment variables into a given struct
@@ -31,7 +65,16 @@ func parseEnvIntoStruct(config interface{}) error {
 	if err := env.Parse(config); err != nil {
 		return err
 	}
-	return validator.New().Struct(config)
+	return newValidator().Struct(config)
+}
+
+// newValidator returns a validator that knows the "identifier" tag for table and schema names
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	_ = validate.RegisterValidation("identifier", func(fl validator.FieldLevel) bool {
+		return store.ValidateIdentifier(fl.Field().String()) == nil
+	})
+	return validate
 }
 
 // UserAuthConfigFromEnv loads the database configuration from the environment
@@ -0,0 +1,21 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_ToConnectionString(t *testing.T) {
+	cfg := Config{Driver: "postgres", Host: "localhost", Port: 5432, User: "user", Pass: "pass", DB: "db"}
+	parsed, err := pgconn.ParseConfig(cfg.ToConnectionString())
+	require.NoError(t, err)
+	require.NotContains(t, parsed.RuntimeParams, "search_path")
+
+	// a mixed-case tenant has to stay quoted, otherwise postgres folds it and falls back to public
+	cfg.SearchPath = []string{"Tenant_A", "public"}
+	parsed, err = pgconn.ParseConfig(cfg.ToConnectionString())
+	require.NoError(t, err)
+	require.Equal(t, `"Tenant_A","public"`, parsed.RuntimeParams["search_path"])
+}
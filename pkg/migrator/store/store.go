@@ -1,10 +1,42 @@
 package store
 
 import (
+	"time"
+
 	"github.com/ymakhloufi/litemigrate/internal/pkg/migration/store"
 	"go.uber.org/zap"
 )
 
-func NewPostgresStore(logger *zap.Logger, migrationTableName, connectionString string) (pgStore *store.PostgresStore, err error) {
-	return store.NewPostgresStore(logger, migrationTableName, connectionString)
+// Option configures optional behaviour of a store
+type Option = store.Option
+
+// DefaultLockTimeout is how long the postgres and mysql stores wait for another process to release the migration lock by default
+const DefaultLockTimeout = store.DefaultLockTimeout
+
+func NewPostgresStore(logger *zap.Logger, migrationTableName, connectionString string, opts ...Option) (pgStore *store.PostgresStore, err error) {
+	return store.NewPostgresStore(logger, migrationTableName, connectionString, opts...)
+}
+
+// WithLockTimeout sets how long the store waits for another process to release the migration lock. Zero waits forever.
+func WithLockTimeout(timeout time.Duration) Option {
+	return store.WithLockTimeout(timeout)
+}
+
+// WithSchema puts the migrations table of the postgres and mysql stores into the given schema, which is created if it
+// doesn't exist yet
+func WithSchema(schema string) Option {
+	return store.WithSchema(schema)
+}
+
+// ErrInvalidIdentifier means the name of the migrations table or its schema isn't a plain SQL identifier
+var ErrInvalidIdentifier = store.ErrInvalidIdentifier
+
+// NewSQLiteStore opens (or creates) the SQLite database file at path
+func NewSQLiteStore(migrationTableName, path string) (sqliteStore *store.SQLiteStore, err error) {
+	return store.NewSQLiteStore(migrationTableName, path)
+}
+
+// NewMySQLStore connects to the MySQL (or MariaDB) server described by dsn, e.g. "user:pass@tcp(localhost:3306)/my_db"
+func NewMySQLStore(logger *zap.Logger, migrationTableName, dsn string, opts ...Option) (mysqlStore *store.MySQLStore, err error) {
+	return store.NewMySQLStore(logger, migrationTableName, dsn, opts...)
 }
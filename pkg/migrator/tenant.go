@@ -0,0 +1,87 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrTenantsFailed means running the migrations failed for at least one tenant, see RunTenants
+var ErrTenantsFailed = fmt.Errorf("migrations failed for some tenants")
+
+// TenantResult is the outcome of running the migrations for a single tenant
+type TenantResult struct {
+	Tenant   string
+	Err      error
+	Duration time.Duration
+}
+
+// TenantResults are the outcomes of RunTenants, in the order the tenants were passed in
+type TenantResults []TenantResult
+
+// Failed returns the number of tenants that failed
+func (r TenantResults) Failed() int {
+	failed := 0
+	for _, result := range r {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Err returns ErrTenantsFailed if any tenant failed, nil otherwise
+func (r TenantResults) Err() error {
+	if failed := r.Failed(); failed > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrTenantsFailed, failed, len(r))
+	}
+	return nil
+}
+
+// RunTenants calls fn for every tenant, e.g. to run Up against each tenant's schema with its own Service, running at
+// most parallelism of them at once. A failing tenant doesn't stop the others. Once ctx is done, tenants that haven't
+// been started yet are skipped and fail with ctx's error.
+func RunTenants(ctx context.Context, tenants []string, parallelism int, fn func(ctx context.Context, tenant string) error) TenantResults {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	results := make(TenantResults, len(tenants))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, tenant := range tenants {
+		results[i].Tenant = tenant
+		if err := acquireSlot(ctx, slots); err != nil {
+			results[i].Err = fmt.Errorf("not started: %w", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *TenantResult) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			start := time.Now()
+			result.Err = fn(ctx, result.Tenant)
+			result.Duration = time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results
+}
+
+// acquireSlot waits for a free slot, unless ctx is done first
+func acquireSlot(ctx context.Context, slots chan struct{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
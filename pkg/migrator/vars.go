@@ -0,0 +1,59 @@
+package migrator
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// ErrTemplateRender means a migration file couldn't be rendered with the template variables, e.g. because it refers
+// to an undefined variable
+var ErrTemplateRender = fmt.Errorf("failed to render migration file")
+
+// WithTemplateVars renders every migration file as a text/template with vars before it is executed, so that
+// migrations can refer to values that differ between environments, e.g. {{.schema}}. Referring to a variable that
+// isn't defined is an error. Checksums are taken from the files as they are, before rendering.
+func WithTemplateVars(vars map[string]string) Option {
+	return func(s *Service) {
+		s.templateVars = make(map[string]string, len(vars))
+		for key, value := range vars {
+			s.templateVars[key] = value
+		}
+	}
+}
+
+// render executes the migration file as a template with the template variables. Without template variables, files
+// are executed as they are, but a file containing template actions such as {{.schema}} is an error, as its variables
+// can't be defined.
+func (s *Service) render(filename, rawSQL string) (string, error) {
+	tmpl, err := template.New(filename).Option("missingkey=error").Parse(rawSQL)
+	if s.templateVars == nil {
+		// files that don't parse as a template, e.g. because of an array literal like '{{1,2},{3,4}}', are plain SQL
+		if err == nil && hasActions(tmpl) {
+			return "", fmt.Errorf("%w %s: refers to template variables, but none are set", ErrTemplateRender, filename)
+		}
+		return rawSQL, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %s", ErrTemplateRender, filename, err)
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, s.templateVars); err != nil {
+		return "", fmt.Errorf("%w %s: %s", ErrTemplateRender, filename, err)
+	}
+	return rendered.String(), nil
+}
+
+// hasActions reports whether the parsed template consists of anything but text
+func hasActions(tmpl *template.Template) bool {
+	if tmpl.Tree == nil {
+		return false
+	}
+	for _, node := range tmpl.Tree.Root.Nodes {
+		if node.Type() != parse.NodeText {
+			return true
+		}
+	}
+	return false
+}